@@ -1,12 +1,14 @@
 package auth
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"klipper-cloud-control-client/config"
 	"net/http"
 	"net/http/cookiejar"
 	"net/url"
+	"strings"
 	"time"
 )
 
@@ -51,17 +53,27 @@ func (cr CodeRequest) GetCode() string {
 	return cr.deviceCode.UserCode
 }
 
-func (cr CodeRequest) GetToken() (*config.Token, error) {
+// GetToken polls for user authorization until it succeeds, expires or ctx is cancelled
+func (cr CodeRequest) GetToken(ctx context.Context) (*config.Token, error) {
 	checker := time.NewTicker(time.Second * time.Duration(cr.deviceCode.Interval))
+	defer checker.Stop()
 	timeout := time.NewTicker(time.Second * time.Duration(cr.deviceCode.ExpiresIn))
+	defer timeout.Stop()
 
 	for {
 		select {
 		case _ = <-checker.C:
-			result, err := http.PostForm(fmt.Sprintf("%s%s", config.GetConfig().GetHostname(), tokenPath), url.Values{
+			form := url.Values{
 				"device_code": []string{cr.deviceCode.DeviceCode},
 				"grant_type":  []string{"http://oauth.net/grant_type/device/1.0"},
-			})
+			}
+			request, err := http.NewRequestWithContext(ctx, http.MethodPost, fmt.Sprintf("%s%s", config.GetConfig().GetHostname(), tokenPath), strings.NewReader(form.Encode()))
+			if err != nil {
+				return nil, err
+			}
+			request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+			result, err := http.DefaultClient.Do(request)
 			if err != nil {
 				return nil, err
 			}
@@ -106,6 +118,8 @@ func (cr CodeRequest) GetToken() (*config.Token, error) {
 
 		case _ = <-timeout.C:
 			return nil, fmt.Errorf("Authentication timed out")
+		case <-ctx.Done():
+			return nil, ctx.Err()
 		}
 	}
 
@@ -117,7 +131,7 @@ func (auth DeviceAuth) GetDeviceCode() (*CodeRequest, error) {
 		return nil, err
 	}
 	if result.StatusCode != 200 {
-		return nil, fmt.Errorf("Failed to get code: %s (%s)", result.StatusCode, result.Status)
+		return nil, fmt.Errorf("Failed to get code: %d (%s)", result.StatusCode, result.Status)
 	}
 
 	body := make([]byte, result.ContentLength)
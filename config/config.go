@@ -21,6 +21,132 @@ type Token struct {
 	IdToken      string    `yaml:"id_token"`
 }
 
+type OutboundConfig struct {
+	QueueSize int               `yaml:"queue_size"`
+	Policies  map[string]string `yaml:"policies"`
+}
+
+type JournalConfig struct {
+	Path       string        `yaml:"path"`
+	MaxEntries int           `yaml:"max_entries"`
+	MaxAge     time.Duration `yaml:"max_age"`
+	MaxBytes   int           `yaml:"max_bytes"`
+}
+
+type PassthroughConfig struct {
+	// Allow lists glob patterns of unbound methods forwarded to Moonraker as is
+	Allow []string `yaml:"allow"`
+}
+
+// ArgumentRule restricts arguments of matching methods. Patterns are globs
+// matched against "root/path" for files and "namespace/key" for database,
+// a pattern matching a parent directory or namespace covers everything below.
+type ArgumentRule struct {
+	// Methods are glob patterns, empty list applies rule to all methods of its kind
+	Methods []string `yaml:"methods"`
+	Allow   []string `yaml:"allow"`
+	Deny    []string `yaml:"deny"`
+}
+
+type PolicyConfig struct {
+	// Presets are named rule sets: read_only, no_machine
+	Presets []string `yaml:"presets"`
+	// Allow and Deny are glob patterns of method names, deny always wins
+	Allow []string `yaml:"allow"`
+	Deny  []string `yaml:"deny"`
+
+	Files    []ArgumentRule `yaml:"files"`
+	Database []ArgumentRule `yaml:"database"`
+}
+
+type GCodeConfig struct {
+	// BlockedCommands and AllowedMacros are glob patterns of command names
+	BlockedCommands        []string `yaml:"blocked_commands"`
+	AllowedMacros          []string `yaml:"allowed_macros"`
+	MaxExtruderTemperature float64  `yaml:"max_extruder_temperature"`
+	MaxBedTemperature      float64  `yaml:"max_bed_temperature"`
+	// MaxFeedrate is in mm/min as F parameter of G0-G3
+	MaxFeedrate float64 `yaml:"max_feedrate"`
+}
+
+type RolesConfig struct {
+	// DefaultRole applies to requests without user, viewer if not set
+	DefaultRole string `yaml:"default_role"`
+	// Roles maps role name to glob patterns of allowed methods, it overrides
+	// built-in viewer, operator and admin roles
+	Roles map[string][]string `yaml:"roles"`
+}
+
+type AuditConfig struct {
+	Path string `yaml:"path"`
+	// MaxSize in bytes triggers rotation, MaxFiles includes the current file
+	MaxSize  int64 `yaml:"max_size"`
+	MaxFiles int   `yaml:"max_files"`
+}
+
+type TimeoutsConfig struct {
+	Default time.Duration `yaml:"default"`
+	// Methods maps method names or glob patterns to timeouts
+	Methods map[string]time.Duration `yaml:"methods"`
+}
+
+type KlippyConfig struct {
+	// WaitReady holds printer.* calls up to this duration while Klippy is not ready
+	WaitReady time.Duration `yaml:"wait_ready"`
+}
+
+// RateLimit is a token bucket with optional cap of concurrent calls, zero values disable limits
+type RateLimit struct {
+	// Rate is number of requests per second refilled into bucket of Burst size
+	Rate        float64 `yaml:"rate"`
+	Burst       int     `yaml:"burst"`
+	Concurrency int     `yaml:"concurrency"`
+}
+
+type LimitsConfig struct {
+	Global RateLimit `yaml:"global"`
+	// Methods maps method names or glob patterns to limits shared by matching methods
+	Methods map[string]RateLimit `yaml:"methods"`
+}
+
+type IdempotencyConfig struct {
+	Path       string        `yaml:"path"`
+	MaxEntries int           `yaml:"max_entries"`
+	MaxAge     time.Duration `yaml:"max_age"`
+}
+
+// StatusConfig throttles status updates forwarded to the cloud. Keys and
+// patterns address whole objects as "object" or single fields as "object/field".
+type StatusConfig struct {
+	// Window merges consecutive updates before forwarding them
+	Window time.Duration `yaml:"window"`
+	// Intervals are minimal intervals between updates of matching fields
+	Intervals map[string]time.Duration `yaml:"intervals"`
+	// Drop lists glob patterns of objects and fields never sent to the cloud
+	Drop []string `yaml:"drop"`
+}
+
+type UsageConfig struct {
+	Path string `yaml:"path"`
+	// MonthlyCap in bytes of both directions switches to low-data mode when exceeded, zero disables it
+	MonthlyCap int64 `yaml:"monthly_cap"`
+}
+
+// CompressionConfig enables permessage-deflate on the cloud link
+type CompressionConfig struct {
+	Enabled bool `yaml:"enabled"`
+	// Level is flate compression level from 1 to 9
+	Level int `yaml:"level"`
+	// MinSize in bytes, smaller messages are sent uncompressed
+	MinSize int `yaml:"min_size"`
+}
+
+type CodecConfig struct {
+	// Offer lists codecs offered to the cloud in order of preference: msgpack, cbor, json.
+	// JSON is used when the cloud accepts none of them.
+	Offer []string `yaml:"offer"`
+}
+
 type Config struct {
 	Hostname        string `yaml:"hostname"`
 	DebugHostname   string `yaml:"debug_hostname"`
@@ -29,6 +155,23 @@ type Config struct {
 	MoonrakerSocket string `yaml:"moonraker_socket"`
 	MoonrakerUrl    string `yaml:"moonraker_url"`
 	Token           *Token `yaml:"token"`
+
+	Outbound OutboundConfig `yaml:"outbound"`
+	Journal  JournalConfig  `yaml:"journal"`
+
+	Passthrough PassthroughConfig `yaml:"passthrough"`
+	Policy      PolicyConfig      `yaml:"policy"`
+	GCode       GCodeConfig       `yaml:"gcode"`
+	Roles       RolesConfig       `yaml:"roles"`
+	Audit       AuditConfig       `yaml:"audit"`
+	Timeouts    TimeoutsConfig    `yaml:"timeouts"`
+	Klippy      KlippyConfig      `yaml:"klippy"`
+	Limits      LimitsConfig      `yaml:"limits"`
+	Idempotency IdempotencyConfig `yaml:"idempotency"`
+	Status      StatusConfig      `yaml:"status"`
+	Usage       UsageConfig       `yaml:"usage"`
+	Compression CompressionConfig `yaml:"compression"`
+	Codec       CodecConfig       `yaml:"codec"`
 }
 
 var config *Config
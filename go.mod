@@ -6,11 +6,15 @@ go 1.18
 
 require (
 	github.com/finomen/go-moonraker-api v0.0.0-20220629214814-6b9fceffb81f
+	github.com/fxamacker/cbor/v2 v2.4.0
 	github.com/gorilla/websocket v1.5.0
+	github.com/vmihailenco/msgpack/v5 v5.3.5
 	gopkg.in/yaml.v2 v2.4.0
 )
 
 require (
 	github.com/kr/pretty v0.3.0 // indirect
 	github.com/satori/go.uuid v1.2.0 // indirect
+	github.com/vmihailenco/tagparser/v2 v2.0.0 // indirect
+	github.com/x448/float16 v0.8.4 // indirect
 )
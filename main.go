@@ -1,24 +1,86 @@
 package main
 
 import (
+	"context"
+	"flag"
 	"fmt"
 	"klipper-cloud-control-client/auth"
 	"klipper-cloud-control-client/config"
 	"klipper-cloud-control-client/rpc"
 	"log"
+	"net/http/cookiejar"
 	"net/url"
 	"os"
 	"os/signal"
 	"sync"
+	"syscall"
 	"time"
 )
 
 const (
 	ReconnectTimeout = time.Second * 5
+	// ShutdownGracePeriod bounds how long in-flight calls may run after a signal
+	ShutdownGracePeriod = time.Second * 10
+	// CloseTimeout bounds how long socket pumps may take to exit after close frames are sent
+	CloseTimeout = time.Second * 5
 )
 
-func main() {
-	config.LoadConfig("config.yaml")
+var verifyAudit = flag.Bool("verify-audit", false, "Verify audit log hash chain and exit")
+
+const (
+	exitOk = iota
+	exitFailure
+	exitForced
+)
+
+// maintain keeps socket connected until ctx is cancelled. Established
+// connection is kept open until connCtx is cancelled so in-flight calls can
+// be completed during shutdown.
+func maintain(ctx context.Context, connCtx context.Context, name string, socketUrl url.URL, jar *cookiejar.Jar, rx chan []byte, tx chan []byte, options rpc.SocketOptions, wg *sync.WaitGroup, connected func(bool)) {
+	defer wg.Done()
+
+	for {
+		socket, err := rpc.NewSocket(connCtx, socketUrl, jar, rx, tx, options, wg)
+		if err != nil {
+			log.Println("Failed to connect to", name, err)
+		} else {
+			log.Println("Connected to", name)
+			connected(true)
+			select {
+			case <-socket.C:
+				connected(false)
+			case <-connCtx.Done():
+				return
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(ReconnectTimeout):
+			log.Println("Reconnecting to", name)
+		}
+	}
+}
+
+func run() int {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	if err := config.LoadConfig("config.yaml"); err != nil {
+		log.Println(err)
+		return exitFailure
+	}
+
+	if *verifyAudit {
+		count, err := rpc.VerifyAuditLog(config.GetConfig().Audit)
+		if err != nil {
+			log.Println("Audit log verification failed after ", count, " entries: ", err)
+			return exitFailure
+		}
+		log.Println("Audit log verified, ", count, " entries")
+		return exitOk
+	}
 
 	if config.GetConfig().Token == nil {
 
@@ -26,104 +88,120 @@ func main() {
 
 		code, err := auth.GetDeviceCode()
 		if err != nil {
-			log.Fatal("Failed to get device code: ", err)
+			log.Println("Failed to get device code: ", err)
+			return exitFailure
 		}
 
 		fmt.Println("Authorize printer using url ", code.GetUrl(), " and code ", code.GetCode())
 
-		token, err := code.GetToken()
+		token, err := code.GetToken(ctx)
 		if err != nil {
-			log.Fatal("Failed to get device token: ", err)
+			log.Println("Failed to get device token: ", err)
+			return exitFailure
 		}
 
 		err = config.StoreToken("config.yaml", token)
 		if err != nil {
-			log.Fatal("Failed to save token: ", err)
+			log.Println("Failed to save token: ", err)
+			return exitFailure
 		}
 	} else {
 		token, err := auth.RefreshToken(*config.GetConfig().Token)
 		if err != nil {
-			log.Fatal("Failed to refresh device token: ", err)
+			log.Println("Failed to refresh device token: ", err)
+			return exitFailure
 		}
 
 		err = config.StoreToken("config.yaml", token)
 		if err != nil {
-			log.Fatal("Failed to save token: ", err)
+			log.Println("Failed to save token: ", err)
+			return exitFailure
 		}
 	}
 
 	jar, err := auth.DoAuth(config.GetConfig().Token)
 
 	if err != nil {
-		log.Fatal("Failed to check token: ", err)
+		log.Println("Failed to check token: ", err)
+		return exitFailure
 	}
 
-	interrupt := make(chan os.Signal, 1)
-	signal.Notify(interrupt, os.Interrupt)
-
 	cloudUrl, err := url.Parse(config.GetConfig().GetUpstream())
 	if err != nil {
-		log.Fatal("Failed to parse hostname: ", err)
+		log.Println("Failed to parse hostname: ", err)
+		return exitFailure
 	}
 
 	moonrakerUrl, err := url.Parse(config.GetConfig().MoonrakerSocket)
 	if err != nil {
-		log.Fatal("Failed to parse moonraker url: ", err)
+		log.Println("Failed to parse moonraker url: ", err)
+		return exitFailure
 	}
 
 	cloudRx := make(chan []byte, rpc.ChannelSize)
-	cloudTx := make(chan []byte, rpc.ChannelSize)
+	// Outbound queue in bridge buffers cloud traffic, keep socket side unbuffered
+	cloudTx := make(chan []byte)
 	printerRx := make(chan []byte, rpc.ChannelSize)
 	printerTx := make(chan []byte, rpc.ChannelSize)
+	// Emergency stop and other urgent calls bypass queued printer traffic
+	printerPriority := make(chan []byte, rpc.ChannelSize)
 
 	wg := &sync.WaitGroup{}
 
-	var cloudSocket *rpc.Socket
-	var printerSocket *rpc.Socket
-
-	_ = rpc.NewBridge(
+	bridge := rpc.NewBridge(
 		cloudRx,
 		cloudTx,
 		printerRx,
-		printerTx, jar)
+		printerTx,
+		printerPriority, jar)
+
+	connCtx, closeConnections := context.WithCancel(context.Background())
+	defer closeConnections()
+
+	wg.Add(2)
+	go maintain(ctx, connCtx, "cloud", *cloudUrl, jar, cloudRx, cloudTx, rpc.SocketOptions{
+		Observer:    bridge.CloudObserver(),
+		Compression: config.GetConfig().Compression,
+		Codecs:      config.GetConfig().Codec.Offer,
+	}, wg, bridge.SetCloudConnected)
+	go maintain(ctx, connCtx, "printer", *moonrakerUrl, jar, printerRx, printerTx, rpc.SocketOptions{
+		// Moonraker is on local network, it is never compressed
+		Priority: printerPriority,
+	}, wg, bridge.SetPrinterConnected)
+
+	<-ctx.Done()
+	stop()
+	log.Println("Shutting down")
+
+	status := exitOk
+
+	graceCtx, cancelGrace := context.WithTimeout(context.Background(), ShutdownGracePeriod)
+	defer cancelGrace()
+	if err := bridge.Shutdown(graceCtx); err != nil {
+		log.Println("In-flight calls aborted: ", err)
+		status = exitForced
+	}
 
-	cloudReconnect := time.NewTicker(3)
-	printerReconnect := time.NewTicker(3)
+	closeConnections()
 
-	for {
-		select {
-		case _ = <-cloudReconnect.C:
-			cloudReconnect.Stop()
-			cloudSocket, err = rpc.NewSocket(*cloudUrl, jar, cloudRx, cloudTx, wg)
-			if err != nil {
-				log.Println("Failed to connect to cloud", err)
-				cloudReconnect.Reset(ReconnectTimeout)
-				continue
-			}
-			log.Println("Connected to cloud")
-
-			go func() {
-				<-cloudSocket.C
-				log.Println("Reconnecting to cloud")
-				cloudReconnect.Reset(ReconnectTimeout)
-			}()
-		case _ = <-printerReconnect.C:
-			printerReconnect.Stop()
-			printerSocket, err = rpc.NewSocket(*moonrakerUrl, jar, printerRx, printerTx, wg)
-			if err != nil {
-				log.Println("Failed to connect to printer", err)
-				continue
-			}
-			printerReconnect.Stop()
-			log.Println("Connected to printer")
-			go func() {
-				<-printerSocket.C
-				log.Println("Reconnecting to printer")
-				printerReconnect.Reset(ReconnectTimeout)
-			}()
-		case <-interrupt:
-			break
-		}
+	closed := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(closed)
+	}()
+
+	select {
+	case <-closed:
+		bridge.Close()
+	case <-time.After(CloseTimeout):
+		log.Println("Connections did not close in time")
+		status = exitForced
 	}
 
+	log.Println("Stopped")
+	return status
+}
+
+func main() {
+	os.Exit(run())
 }
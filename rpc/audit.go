@@ -0,0 +1,377 @@
+package rpc
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/finomen/go-moonraker-api/jsonrpc"
+	"klipper-cloud-control-client/config"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultAuditPath     = "audit.jsonl"
+	DefaultAuditMaxSize  = 10 * 1024 * 1024
+	DefaultAuditMaxFiles = 5
+	// auditRecent is the number of entries kept in memory for remote queries
+	auditRecent       = 1000
+	auditMaxParamSize = 512
+	auditRedacted     = "<redacted>"
+	// auditMaxResultSize bounds sanitized result stored in entry, larger
+	// results are recorded by size only
+	auditMaxResultSize = 4096
+)
+
+// auditHashSuffix is appended to entry body, hash covers body bytes exactly
+const auditHashSuffix = `,"hash":"`
+
+var auditSecrets = []string{"password", "token", "secret", "api_key", "apikey", "auth"}
+
+type AuditEntry struct {
+	Seq       uint64          `json:"seq"`
+	Time      time.Time       `json:"time"`
+	Method    string          `json:"method"`
+	Params    json.RawMessage `json:"params,omitempty"`
+	User      *CloudUser      `json:"user,omitempty"`
+	Error     *Error          `json:"error,omitempty"`
+	LatencyMs float64         `json:"latency_ms"`
+	// Ok is set for successful calls, ResultSize is encoded size of result
+	// returned to cloud and Result is its sanitized copy
+	Ok         bool            `json:"ok"`
+	ResultSize int             `json:"result_size,omitempty"`
+	Result     json.RawMessage `json:"result,omitempty"`
+	// Prev is hash of previous entry, it chains entries across rotated files
+	Prev string `json:"prev"`
+	Hash string `json:"hash,omitempty"`
+}
+
+type AuditRecentRequest struct {
+	Limit int `json:"limit"`
+}
+
+type AuditRecentResponse struct {
+	Entries []AuditEntry `json:"entries"`
+}
+
+// AuditRecent lets cloud query latest audited operations
+var AuditRecent = jsonrpc.Method[AuditRecentRequest, AuditRecentResponse]{Name: "kcc.audit.recent"}
+
+// Audit writes tamper-evident log of cloud-initiated calls. Each entry
+// carries hash of the previous one, so removing or altering an entry breaks
+// the chain which is detected by VerifyAuditLog.
+type Audit struct {
+	mutex    sync.Mutex
+	path     string
+	maxSize  int64
+	maxFiles int
+	file     *os.File
+	size     int64
+	seq      uint64
+	last     string
+	recent   []AuditEntry
+}
+
+// sanitize redacts secrets and truncates long values in request params
+func sanitize(value interface{}) interface{} {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		for key, item := range v {
+			lower := strings.ToLower(key)
+			redacted := false
+			for _, secret := range auditSecrets {
+				if strings.Contains(lower, secret) {
+					v[key] = auditRedacted
+					redacted = true
+					break
+				}
+			}
+			if !redacted {
+				v[key] = sanitize(item)
+			}
+		}
+		return v
+	case []interface{}:
+		for i, item := range v {
+			v[i] = sanitize(item)
+		}
+		return v
+	case string:
+		if len(v) > auditMaxParamSize {
+			return v[:auditMaxParamSize] + "..."
+		}
+		return v
+	default:
+		return v
+	}
+}
+
+func sanitizeParams(params json.RawMessage) json.RawMessage {
+	if len(params) == 0 {
+		return nil
+	}
+	var value interface{}
+	if err := json.Unmarshal(params, &value); err != nil {
+		return nil
+	}
+	data, err := json.Marshal(sanitize(value))
+	if err != nil {
+		return nil
+	}
+	return data
+}
+
+func auditHash(body []byte) string {
+	sum := sha256.Sum256(body)
+	return hex.EncodeToString(sum[:])
+}
+
+// splitAuditLine separates entry body from its hash
+func splitAuditLine(line []byte) ([]byte, string, error) {
+	pos := bytes.LastIndex(line, []byte(auditHashSuffix))
+	if pos < 0 || !bytes.HasSuffix(line, []byte(`"}`)) {
+		return nil, "", fmt.Errorf("entry has no hash")
+	}
+	hash := string(line[pos+len(auditHashSuffix) : len(line)-2])
+	body := append(append([]byte{}, line[:pos]...), '}')
+	return body, hash, nil
+}
+
+func rotatedAuditPath(path string, n int) string {
+	if n == 0 {
+		return path
+	}
+	return fmt.Sprintf("%s.%d", path, n)
+}
+
+// rotate shifts audit files keeping at most maxFiles, must be called under lock
+func (a *Audit) rotate() error {
+	if a.file != nil {
+		a.file.Close()
+		a.file = nil
+	}
+	os.Remove(rotatedAuditPath(a.path, a.maxFiles-1))
+	for n := a.maxFiles - 2; n >= 0; n-- {
+		if err := os.Rename(rotatedAuditPath(a.path, n), rotatedAuditPath(a.path, n+1)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	a.size = 0
+	return nil
+}
+
+func (a *Audit) write(line []byte) error {
+	if a.size+int64(len(line)) > a.maxSize && a.size > 0 {
+		if err := a.rotate(); err != nil {
+			return err
+		}
+	}
+	if a.file == nil {
+		file, err := os.OpenFile(a.path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+		if err != nil {
+			return err
+		}
+		info, err := file.Stat()
+		if err != nil {
+			file.Close()
+			return err
+		}
+		a.file = file
+		a.size = info.Size()
+	}
+	n, err := a.file.Write(line)
+	a.size += int64(n)
+	return err
+}
+
+// sanitizeResult sanitizes result like params, it returns nil if result is too large
+func sanitizeResult(result json.RawMessage) json.RawMessage {
+	sanitized := sanitizeParams(result)
+	if len(sanitized) > auditMaxResultSize {
+		return nil
+	}
+	return sanitized
+}
+
+// Record appends audit entry for completed cloud call
+func (a *Audit) Record(method string, params json.RawMessage, result json.RawMessage, user *CloudUser, callErr *Error, latency time.Duration) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	a.seq++
+	entry := AuditEntry{
+		Seq:        a.seq,
+		Time:       time.Now(),
+		Method:     method,
+		Params:     sanitizeParams(params),
+		User:       user,
+		Error:      callErr,
+		Ok:         callErr == nil,
+		ResultSize: len(result),
+		Result:     sanitizeResult(result),
+		LatencyMs:  float64(latency.Microseconds()) / 1000,
+		Prev:       a.last,
+	}
+
+	body, err := json.Marshal(entry)
+	if err != nil {
+		log.Println("Failed to serialize audit entry: ", err)
+		return
+	}
+	entry.Hash = auditHash(body)
+
+	line := make([]byte, 0, len(body)+len(auditHashSuffix)+len(entry.Hash)+3)
+	line = append(line, body[:len(body)-1]...)
+	line = append(line, auditHashSuffix...)
+	line = append(line, entry.Hash...)
+	line = append(line, `"}`...)
+	line = append(line, '\n')
+
+	if err := a.write(line); err != nil {
+		log.Println("Failed to write audit log: ", err)
+	}
+	a.last = entry.Hash
+
+	a.recent = append(a.recent, entry)
+	if len(a.recent) > auditRecent {
+		a.recent = a.recent[len(a.recent)-auditRecent:]
+	}
+}
+
+// Recent returns up to limit latest entries, newest last
+func (a *Audit) Recent(limit int) []AuditEntry {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	if limit <= 0 || limit > len(a.recent) {
+		limit = len(a.recent)
+	}
+	return append([]AuditEntry{}, a.recent[len(a.recent)-limit:]...)
+}
+
+// load restores chain head and recent entries from existing files
+func (a *Audit) load() {
+	for n := a.maxFiles - 1; n >= 0; n-- {
+		file, err := os.Open(rotatedAuditPath(a.path, n))
+		if err != nil {
+			continue
+		}
+		scanner := bufio.NewScanner(file)
+		scanner.Buffer(make([]byte, 0, 64*1024), MaxMessageSize)
+		for scanner.Scan() {
+			entry := AuditEntry{}
+			if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+				continue
+			}
+			a.seq = entry.Seq
+			a.last = entry.Hash
+			if n == 0 {
+				a.recent = append(a.recent, entry)
+				if len(a.recent) > auditRecent {
+					a.recent = a.recent[1:]
+				}
+			}
+		}
+		file.Close()
+	}
+}
+
+func (a *Audit) Close() {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	if a.file != nil {
+		a.file.Close()
+		a.file = nil
+	}
+}
+
+func auditConfig(cfg config.AuditConfig) (string, int64, int) {
+	path := cfg.Path
+	if path == "" {
+		path = DefaultAuditPath
+	}
+	maxSize := cfg.MaxSize
+	if maxSize <= 0 {
+		maxSize = DefaultAuditMaxSize
+	}
+	maxFiles := cfg.MaxFiles
+	if maxFiles <= 0 {
+		maxFiles = DefaultAuditMaxFiles
+	}
+	return path, maxSize, maxFiles
+}
+
+func NewAudit(cfg config.AuditConfig) *Audit {
+	path, maxSize, maxFiles := auditConfig(cfg)
+	audit := &Audit{
+		path:     path,
+		maxSize:  maxSize,
+		maxFiles: maxFiles,
+	}
+
+	audit.load()
+
+	return audit
+}
+
+// VerifyAuditLog checks hash chain of audit log including rotated files, it
+// returns number of verified entries. Chain start is trusted when the oldest
+// files were already rotated away.
+func VerifyAuditLog(cfg config.AuditConfig) (int, error) {
+	path, _, maxFiles := auditConfig(cfg)
+
+	count := 0
+	prev := ""
+	anchored := false
+	for n := maxFiles - 1; n >= 0; n-- {
+		name := rotatedAuditPath(path, n)
+		file, err := os.Open(name)
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return count, err
+		}
+
+		scanner := bufio.NewScanner(file)
+		scanner.Buffer(make([]byte, 0, 64*1024), MaxMessageSize)
+		line := 0
+		for scanner.Scan() {
+			line++
+			body, hash, err := splitAuditLine(scanner.Bytes())
+			if err != nil {
+				file.Close()
+				return count, fmt.Errorf("%s:%d: %v", name, line, err)
+			}
+			if auditHash(body) != hash {
+				file.Close()
+				return count, fmt.Errorf("%s:%d: hash mismatch, entry was modified", name, line)
+			}
+			entry := AuditEntry{}
+			if err := json.Unmarshal(body, &entry); err != nil {
+				file.Close()
+				return count, fmt.Errorf("%s:%d: %v", name, line, err)
+			}
+			if anchored && entry.Prev != prev {
+				file.Close()
+				return count, fmt.Errorf("%s:%d: chain broken, entries were removed or reordered", name, line)
+			}
+			anchored = true
+			prev = hash
+			count++
+		}
+		err = scanner.Err()
+		file.Close()
+		if err != nil {
+			return count, err
+		}
+	}
+	return count, nil
+}
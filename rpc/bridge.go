@@ -2,6 +2,8 @@ package rpc
 
 import (
 	"bytes"
+	"context"
+	"encoding/json"
 	"github.com/finomen/go-moonraker-api/api"
 	"github.com/finomen/go-moonraker-api/jsonrpc"
 	"io/ioutil"
@@ -10,66 +12,179 @@ import (
 	"net/http"
 	"net/http/cookiejar"
 	"path"
+	"sync"
 	"time"
 )
 
 const (
+	// timeout is used for calls issued by the bridge itself and as default for cloud calls
 	timeout = time.Second * 15
 )
 
 type Bridge struct {
-	printerConnection *jsonrpc.Client
-	cloudConnection   *jsonrpc.Client
-	jar               *cookiejar.Jar
-}
-
-func bind[Request interface{}, Response interface{}](method jsonrpc.Method[Request, Response], from *jsonrpc.Client, to *jsonrpc.Client) {
-	method.Listen(func(req *Request) Response {
-		var def Response
-		//log.Println("->", method.Name)
-		var reqValue Request
-		if req != nil {
-			reqValue = *req
+	printer         *RawClient
+	cloudConnection *jsonrpc.Client
+	handlers        map[string]Handler
+	relayed         map[string]struct{}
+	passthrough     []string
+	policy          *Policy
+	gcode           *GCodeInspector
+	roles           *Roles
+	audit           *Audit
+	timeouts        *Timeouts
+	klippyWait      time.Duration
+	limiter         *Limiter
+	idempotency     *Idempotency
+	throttle        *StatusThrottle
+	link            *LinkMonitor
+	usage           *Usage
+	pending         *PendingCalls
+	cloudOutbound   *Outbound
+	journal         *Journal
+	state           *PrinterState
+	subscriptions   *Subscriptions
+	jar             *cookiejar.Jar
+
+	// ctx aborts long-running work such as uploads, it is cancelled by Shutdown
+	ctx    context.Context
+	cancel context.CancelFunc
+	done   chan struct{}
+
+	mutex    sync.Mutex
+	closing  bool
+	inFlight sync.WaitGroup
+}
+
+// begin registers in-flight work, it returns false once shutdown started
+func (b *Bridge) begin() bool {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if b.closing {
+		return false
+	}
+	b.inFlight.Add(1)
+	return true
+}
+
+func (b *Bridge) end() {
+	b.inFlight.Done()
+}
+
+// spawn runs work in background accounted as in-flight
+func (b *Bridge) spawn(work func()) {
+	if !b.begin() {
+		return
+	}
+	go func() {
+		defer b.end()
+		work()
+	}()
+}
+
+// prepare adjusts cloud request before it is forwarded to printer
+func (b *Bridge) prepare(method string, request interface{}) {
+	switch method {
+	case api.PrinterObjectsSubscribe.Name:
+		if req, ok := request.(*api.PrinterObjectsQueryRequest); ok {
+			*req = b.subscriptions.Add(*req)
 		}
-		res, err := method.Call(reqValue, timeout, to)
-		//log.Println("<-", method.Name)
-		if err != nil {
-			log.Println("Call ", method.Name, " failed: ", err)
-			//FIXME: return error!
-			return def
+	}
+}
+
+// validate rejects cloud request before it is forwarded to printer
+func (b *Bridge) validate(ctx context.Context, method string, request interface{}) *Error {
+	switch method {
+	case api.PrinterGCodeScript.Name:
+		if req, ok := request.(*api.PrinterGCodeScriptRequest); ok {
+			return b.gcode.Check(ctx, req.Script, b.printer)
+		}
+	case api.ServerFilesDeleteFile.Name:
+		if req, ok := request.(*api.ServerFilesDeleteFileRequest); ok {
+			return b.policy.CheckFiles(method, req.Path)
+		}
+	case api.ServerFilesMove.Name:
+		if req, ok := request.(*api.ServerFilesMoveRequest); ok {
+			return b.policy.CheckFiles(method, req.Source, req.Dest)
+		}
+	case api.ServerFilesCopy.Name:
+		if req, ok := request.(*api.ServerFilesCopyRequest); ok {
+			return b.policy.CheckFiles(method, req.Source, req.Dest)
+		}
+	case api.ServerFilesPostDirectory.Name:
+		if req, ok := request.(*api.ServerFilesPostDirectoryRequest); ok {
+			return b.policy.CheckFiles(method, req.Path)
 		}
-		if res == nil {
-			//FIXME: should not happen
-			return def
+	case api.ServerFilesDeleteDirectory.Name:
+		if req, ok := request.(*api.ServerFilesDeleteDirectoryRequest); ok {
+			return b.policy.CheckFiles(method, req.Path)
 		}
-		return *res
-	}, from)
+	case api.ServerDatabasePostItem.Name:
+		if req, ok := request.(*api.ServerDatabasePostItemRequest); ok {
+			return b.policy.CheckDatabase(method, req.Namespace, req.Key)
+		}
+	case api.ServerDatabaseDeleteItem.Name:
+		if req, ok := request.(*api.ServerDatabaseDeleteItemRequest); ok {
+			return b.policy.CheckDatabase(method, req.Namespace, req.Key)
+		}
+	}
+	return nil
+}
+
+// observe updates bridge state from result of a call to printer
+func (b *Bridge) observe(method string, result json.RawMessage) {
+	b.state.ObserveResult(method, result)
+	b.gcode.ObserveResult(method, result)
+}
+
+func bind[Request interface{}, Response interface{}](method jsonrpc.Method[Request, Response], bridge *Bridge, to *RawClient) {
+	bridge.handle(method.Name, func(ctx context.Context, params json.RawMessage) (json.RawMessage, *Error) {
+		var request Request
+		if err := decodeParams(params, &request); err != nil {
+			return nil, NewError(ErrorInvalidParams, "Invalid params: %v", err)
+		}
+		if err := bridge.awaitKlippy(ctx, method.Name, params); err != nil {
+			return nil, err
+		}
+		if err := bridge.validate(ctx, method.Name, &request); err != nil {
+			return nil, err
+		}
+		bridge.prepare(method.Name, &request)
+		result, err := to.Call(ctx, method.Name, request)
+		if err != nil {
+			return nil, err
+		}
+		bridge.observe(method.Name, result)
+		return result, nil
+	})
 }
 
 func cloudToPrinter[Request interface{}, Response interface{}](method jsonrpc.Method[Request, Response], bridge *Bridge) {
-	bind(method, bridge.cloudConnection, bridge.printerConnection)
+	bind(method, bridge, bridge.printer)
 }
 
+// printerToCloud forwards printer notification to cloud through relay fast path
 func printerToCloud[Request interface{}](method jsonrpc.Notify[Request], bridge *Bridge) {
-	method.Listen(func(req *Request) {
-		var reqValue Request
-		if req != nil {
-			reqValue = *req
-		}
-		method.Send(reqValue, bridge.cloudConnection)
-	}, bridge.printerConnection)
+	bridge.relayed[method.Name] = struct{}{}
 }
 
 func (b *Bridge) uploadFile(path string, id string) {
+	defer b.end()
+
 	client := http.Client{ // TODO: share client? make upload queue
 		Jar: b.jar,
 	}
 	log.Println("Start upload ", path)
-	file, err := http.Get(config.GetConfig().MoonrakerUrl + path)
+	getRequest, err := http.NewRequestWithContext(b.ctx, http.MethodGet, config.GetConfig().MoonrakerUrl+path, nil)
+	if err != nil {
+		log.Println("Get file failed")
+		return
+	}
+	file, err := http.DefaultClient.Do(getRequest)
 	if err != nil {
 		log.Println("Get file failed")
 		return
 	}
+	defer file.Body.Close()
 
 	data, err := ioutil.ReadAll(file.Body)
 
@@ -78,20 +193,166 @@ func (b *Bridge) uploadFile(path string, id string) {
 		return
 	}
 
-	_, err = client.Post(config.GetConfig().GetHostname()+"/api/download?download-id="+id, file.Header.Get("Content-Type"), bytes.NewBuffer(data))
+	postRequest, err := http.NewRequestWithContext(b.ctx, http.MethodPost, config.GetConfig().GetHostname()+"/api/download?download-id="+id, bytes.NewBuffer(data))
+	if err != nil {
+		log.Println("Upload file failed")
+		return
+	}
+	postRequest.Header.Set("Content-Type", file.Header.Get("Content-Type"))
+
+	result, err := client.Do(postRequest)
 
 	if err != nil {
-		log.Println("Get file failed")
+		log.Println("Upload file failed")
+		return
+	}
+	result.Body.Close()
+	// Failed uploads are retried by the cloud, only the delivered one counts
+	b.usage.Add(UsageTx, CategoryFiles, len(data))
+}
+
+// Shutdown stops accepting cloud calls and waits for in-flight calls and
+// uploads until ctx expires, then aborts whatever is still running. It
+// returns ctx error if the grace period was exceeded.
+func (b *Bridge) Shutdown(ctx context.Context) error {
+	b.mutex.Lock()
+	b.closing = true
+	b.mutex.Unlock()
+
+	drained := make(chan struct{})
+	go func() {
+		b.inFlight.Wait()
+		close(drained)
+	}()
+
+	var err error
+	select {
+	case <-drained:
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+	b.cancel()
+	return err
+}
+
+// SetCloudConnected is called by socket owner on cloud connection state change
+func (b *Bridge) SetCloudConnected(connected bool) {
+	b.cloudOutbound.SetConnected(connected)
+	if connected {
+		b.subscriptions.Reset()
+		// Quality of previous connection no longer holds back the uplink
+		b.link.Reset()
+		b.applyQuality(b.link.Last())
+		b.reportUsage(b.usage.Stats())
+		b.spawn(b.pushSnapshot)
+	}
+}
+
+// SetPrinterConnected is called by socket owner on printer connection state change
+func (b *Bridge) SetPrinterConnected(connected bool) {
+	b.state.SetPrinterConnected(connected)
+	b.gcode.Invalidate()
+	if connected {
+		b.printer.Connected()
+		b.spawn(b.restore)
+	} else {
+		b.printer.Disconnected()
+	}
+	PrinterConnectionNotify.Send([]PrinterConnection{{
+		Connected: connected,
+		Time:      time.Now(),
+	}}, b.cloudConnection)
+}
+
+// resubscribe replays cloud subscriptions lost by Moonraker or Klippy restart
+func (b *Bridge) resubscribe() {
+	if b.subscriptions.Empty() {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(b.ctx, timeout)
+	defer cancel()
+
+	request := b.subscriptions.Request()
+	result, err := b.printer.Call(ctx, api.PrinterObjectsSubscribe.Name, request)
+	if err != nil {
+		log.Println("Failed to restore subscriptions: ", err)
 		return
 	}
+	b.observe(api.PrinterObjectsSubscribe.Name, result)
+	log.Println("Restored ", len(request.Objects), " subscriptions")
+
+	b.pushSnapshot()
+}
+
+// restore exposes klippy state to cloud and replays subscriptions after printer reconnect
+func (b *Bridge) restore() {
+	b.pushSnapshot()
+	if state, _ := b.state.KlippyState(); state == KlippyReady {
+		b.resubscribe()
+	}
+}
+
+// pushSnapshot sends mirrored printer state to cloud session
+func (b *Bridge) pushSnapshot() {
+	if b.state.PrinterConnected() {
+		ctx, cancel := context.WithTimeout(b.ctx, timeout)
+		b.refreshKlippyState(ctx)
+		cancel()
+	}
+
+	// Journal position is taken first so snapshot covers at least everything up to it
+	seq := b.journal.LastSeq()
+	snapshot := b.state.Snapshot()
+	snapshot.Seq = seq
+	StateSnapshotNotify.Send([]StateSnapshot{snapshot}, b.cloudConnection)
+}
+
+// Close releases jsonrpc clients, call it after both sockets are closed
+func (b *Bridge) Close() {
+	b.cancel()
+	close(b.done)
+	b.throttle.Close()
+	b.cloudConnection.Close()
+	b.printer.Close()
+	b.cloudOutbound.Close()
+	b.journal.Close()
+	b.idempotency.Close()
+	b.usage.Close()
+	b.audit.Close()
 }
 
-func NewBridge(cloudRx chan []byte, cloudTx chan []byte, printerRx chan []byte, printerTx chan []byte, jar *cookiejar.Jar) *Bridge {
+func NewBridge(cloudRx chan []byte, cloudTx chan []byte, printerRx chan []byte, printerTx chan []byte, printerPriority chan []byte, jar *cookiejar.Jar) *Bridge {
+	ctx, cancel := context.WithCancel(context.Background())
+	outbound := NewOutbound(cloudTx, config.GetConfig().Outbound)
+	cloudFallback := make(chan []byte, ChannelSize)
 	bridge := &Bridge{
-		printerConnection: jsonrpc.NewClient(printerRx, printerTx),
-		cloudConnection:   jsonrpc.NewClient(cloudRx, cloudTx),
-		jar:               jar,
+		cloudConnection: jsonrpc.NewClient(cloudFallback, outbound.C()),
+		handlers:        map[string]Handler{},
+		relayed:         map[string]struct{}{},
+		passthrough:     config.GetConfig().Passthrough.Allow,
+		policy:          NewPolicy(config.GetConfig().Policy),
+		gcode:           NewGCodeInspector(config.GetConfig().GCode),
+		roles:           NewRoles(config.GetConfig().Roles),
+		audit:           NewAudit(config.GetConfig().Audit),
+		timeouts:        NewTimeouts(config.GetConfig().Timeouts),
+		klippyWait:      config.GetConfig().Klippy.WaitReady,
+		limiter:         NewLimiter(config.GetConfig().Limits),
+		idempotency:     NewIdempotency(config.GetConfig().Idempotency),
+		link:            NewLinkMonitor(),
+		usage:           NewUsage(config.GetConfig().Usage),
+		pending:         NewPendingCalls(),
+		cloudOutbound:   outbound,
+		journal:         NewJournal(config.GetConfig().Journal),
+		state:           NewPrinterState(),
+		subscriptions:   NewSubscriptions(),
+		jar:             jar,
+		ctx:             ctx,
+		cancel:          cancel,
+		done:            make(chan struct{}),
 	}
+	bridge.throttle = NewStatusThrottle(config.GetConfig().Status, bridge.publishStatus)
+	bridge.printer = NewRawClient(printerRx, printerTx, printerPriority, bridge.relay)
 	cloudToPrinter(api.ServerConnectionIdentity, bridge)
 	cloudToPrinter(api.GetWebsocketId, bridge)
 	cloudToPrinter(api.PrinterInfo, bridge)
@@ -174,13 +435,57 @@ func NewBridge(cloudRx chan []byte, cloudTx chan []byte, printerRx chan []byte,
 	printerToCloud(api.NotifyServiceStateChanged, bridge)
 	printerToCloud(api.NotifyJobQueueChanged, bridge)
 
-	api.CloudUpload.Listen(func(request *api.CloudUploadRequest) api.CloudUploadResponse {
+	serve(JournalSince, bridge, func(ctx context.Context, request *JournalSinceRequest) (*JournalSinceResponse, *Error) {
+		response := bridge.journal.Since(request.Seq, request.Limit)
+		return &response, nil
+	})
+
+	serve(Cancel, bridge, func(ctx context.Context, request *CancelRequest) (*CancelResponse, *Error) {
+		return &CancelResponse{
+			Cancelled: bridge.pending.Cancel(request.Id, userFromContext(ctx)),
+		}, nil
+	})
+
+	serve(LimitsStats, bridge, func(ctx context.Context, request *LimitsStatsRequest) (*LimitsStatsResponse, *Error) {
+		stats := bridge.limiter.Stats()
+		return &stats, nil
+	})
+
+	serve(AuditRecent, bridge, func(ctx context.Context, request *AuditRecentRequest) (*AuditRecentResponse, *Error) {
+		return &AuditRecentResponse{
+			Entries: bridge.audit.Recent(request.Limit),
+		}, nil
+	})
+
+	serve(UsageStatsMethod, bridge, func(ctx context.Context, request *UsageStatsRequest) (*UsageStats, *Error) {
+		stats := bridge.usage.Stats()
+		return &stats, nil
+	})
+
+	serve(LinkStats, bridge, func(ctx context.Context, request *LinkStatsRequest) (*LinkQuality, *Error) {
+		stats := bridge.link.Stats(bridge.cloudOutbound.Backlog())
+		return &stats, nil
+	})
+
+	serve(api.CloudUpload, bridge, func(ctx context.Context, request *api.CloudUploadRequest) (*api.CloudUploadResponse, *Error) {
+		if bridge.usage.LowData() {
+			return nil, NewError(ErrorDataCapExceeded, "Monthly data cap exceeded, uploads are disabled")
+		}
 		//TODO: wait for success
+		if !bridge.begin() {
+			return &api.CloudUploadResponse{
+				Status: http.StatusServiceUnavailable,
+			}, nil
+		}
 		go bridge.uploadFile(path.Join(request.Root, request.Path), request.DownloadId.String())
-		return api.CloudUploadResponse{
+		return &api.CloudUploadResponse{
 			Status: 200, //TODO:
-		}
-	}, bridge.cloudConnection)
+		}, nil
+	})
+
+	go bridge.dispatchCloud(cloudRx, cloudFallback)
+	go bridge.monitorLink()
+	go bridge.monitorUsage()
 
 	return bridge
 }
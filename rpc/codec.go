@@ -0,0 +1,150 @@
+package rpc
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/fxamacker/cbor/v2"
+	"github.com/gorilla/websocket"
+	"github.com/vmihailenco/msgpack/v5"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+const (
+	CodecJSON    = "json"
+	CodecMsgpack = "msgpack"
+	CodecCBOR    = "cbor"
+)
+
+// codecSubprotocolPrefix prefixes codec names in websocket subprotocol negotiation
+const codecSubprotocolPrefix = "kcc.jsonrpc."
+
+// Codec converts jsonrpc messages between JSON used inside the client and
+// wire format of the cloud link
+type Codec interface {
+	Name() string
+	// MessageType is websocket frame type of encoded messages
+	MessageType() int
+	Encode(message []byte) ([]byte, error)
+	Decode(data []byte) ([]byte, error)
+}
+
+type jsonCodec struct {
+}
+
+func (jsonCodec) Name() string {
+	return CodecJSON
+}
+
+func (jsonCodec) MessageType() int {
+	return websocket.TextMessage
+}
+
+func (jsonCodec) Encode(message []byte) ([]byte, error) {
+	return message, nil
+}
+
+func (jsonCodec) Decode(data []byte) ([]byte, error) {
+	return data, nil
+}
+
+// binaryCodec transcodes JSON through generic values
+type binaryCodec struct {
+	name      string
+	marshal   func(value interface{}) ([]byte, error)
+	unmarshal func(data []byte, value interface{}) error
+}
+
+func (c binaryCodec) Name() string {
+	return c.name
+}
+
+func (binaryCodec) MessageType() int {
+	return websocket.BinaryMessage
+}
+
+func (c binaryCodec) Encode(message []byte) ([]byte, error) {
+	decoder := json.NewDecoder(bytes.NewReader(message))
+	decoder.UseNumber()
+	var value interface{}
+	if err := decoder.Decode(&value); err != nil {
+		return nil, err
+	}
+	return c.marshal(numbers(value))
+}
+
+func (c binaryCodec) Decode(data []byte) ([]byte, error) {
+	var value interface{}
+	if err := c.unmarshal(data, &value); err != nil {
+		return nil, err
+	}
+	return json.Marshal(value)
+}
+
+// numbers replaces JSON numbers with integers where possible, so they are
+// encoded as integers instead of strings or floats
+func numbers(value interface{}) interface{} {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		for key, item := range v {
+			v[key] = numbers(item)
+		}
+		return v
+	case []interface{}:
+		for i, item := range v {
+			v[i] = numbers(item)
+		}
+		return v
+	case json.Number:
+		if i, err := v.Int64(); err == nil {
+			return i
+		}
+		if u, err := strconv.ParseUint(string(v), 10, 64); err == nil {
+			return u
+		}
+		f, _ := v.Float64()
+		return f
+	default:
+		return v
+	}
+}
+
+var cborDecoder, _ = cbor.DecOptions{
+	DefaultMapType: reflect.TypeOf(map[string]interface{}{}),
+}.DecMode()
+
+var codecs = map[string]Codec{
+	CodecJSON: jsonCodec{},
+	CodecMsgpack: binaryCodec{
+		name:      CodecMsgpack,
+		marshal:   msgpack.Marshal,
+		unmarshal: msgpack.Unmarshal,
+	},
+	CodecCBOR: binaryCodec{
+		name:      CodecCBOR,
+		marshal:   cbor.Marshal,
+		unmarshal: cborDecoder.Unmarshal,
+	},
+}
+
+// codecSubprotocols lists subprotocols offered to the peer in order of preference
+func codecSubprotocols(names []string) []string {
+	var subprotocols []string
+	for _, name := range names {
+		if _, ok := codecs[name]; ok {
+			subprotocols = append(subprotocols, codecSubprotocolPrefix+name)
+		}
+	}
+	return subprotocols
+}
+
+// negotiatedCodec returns codec selected by peer, JSON if it selected none
+func negotiatedCodec(subprotocol string) Codec {
+	if strings.HasPrefix(subprotocol, codecSubprotocolPrefix) {
+		if codec, ok := codecs[strings.TrimPrefix(subprotocol, codecSubprotocolPrefix)]; ok {
+			return codec
+		}
+	}
+	return codecs[CodecJSON]
+}
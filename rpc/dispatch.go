@@ -0,0 +1,288 @@
+package rpc
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"github.com/finomen/go-moonraker-api/jsonrpc"
+	"log"
+	"sync"
+	"time"
+)
+
+// Handler serves cloud request, result is sent back to the cloud as is
+type Handler func(ctx context.Context, params json.RawMessage) (json.RawMessage, *Error)
+
+type cloudRequest struct {
+	Jsonrpc string           `json:"jsonrpc"`
+	Id      *json.RawMessage `json:"id"`
+	Method  string           `json:"method"`
+	Params  json.RawMessage  `json:"params"`
+	// User is kcc extension identifying acting cloud user
+	User *CloudUser `json:"user,omitempty"`
+	// IdempotencyKey is kcc extension, retried mutating requests with the same key are executed once
+	IdempotencyKey string `json:"idempotency_key,omitempty"`
+}
+
+type cloudResponse struct {
+	Jsonrpc string          `json:"jsonrpc"`
+	Id      json.RawMessage `json:"id"`
+	Result  json.RawMessage `json:"result,omitempty"`
+	Error   *Error          `json:"error,omitempty"`
+}
+
+// handle registers handler for cloud requests of method
+func (b *Bridge) handle(method string, handler Handler) {
+	b.handlers[method] = handler
+}
+
+// dispatchCloud serves cloud requests with registered handlers or passthrough,
+// responses are passed to fallback channel read by cloud jsonrpc.Client
+func (b *Bridge) dispatchCloud(rx chan []byte, fallback chan []byte) {
+	for {
+		select {
+		case data := <-rx:
+			if isBatch(data) {
+				b.dispatchBatch(data)
+				continue
+			}
+			if b.dispatch(data) {
+				continue
+			}
+			select {
+			case fallback <- data:
+			case <-b.done:
+				return
+			}
+		case <-b.done:
+			return
+		}
+	}
+}
+
+func (b *Bridge) dispatch(data []byte) bool {
+	request := cloudRequest{}
+	if err := json.Unmarshal(data, &request); err != nil {
+		return false
+	}
+	if request.Method == "" {
+		return false
+	}
+
+	started := time.Now()
+
+	handler, release, err := b.admit(&request)
+	if err != nil {
+		b.send(b.complete(&request, started, nil, err))
+		return true
+	}
+
+	go func() {
+		defer release()
+		result, err := b.run(&request, handler)
+		b.send(b.complete(&request, started, result, err))
+	}()
+	return true
+}
+
+// isBatch reports whether message is a JSON-RPC batch array
+func isBatch(data []byte) bool {
+	trimmed := bytes.TrimLeft(data, " \t\r\n")
+	return len(trimmed) > 0 && trimmed[0] == '['
+}
+
+// dispatchBatch runs batch entries concurrently and sends single batch
+// response once all of them complete. Notifications get no response entry
+// and nothing is sent if batch consists of notifications only.
+func (b *Bridge) dispatchBatch(data []byte) {
+	var items []json.RawMessage
+	if err := json.Unmarshal(data, &items); err != nil {
+		b.send(errorResponse(NewError(ErrorParse, "Parse error: %v", err)))
+		return
+	}
+	if len(items) == 0 {
+		b.send(errorResponse(NewError(ErrorInvalidRequest, "Empty batch")))
+		return
+	}
+
+	started := time.Now()
+	responses := make([]*cloudResponse, len(items))
+	wg := sync.WaitGroup{}
+	for i, item := range items {
+		request := &cloudRequest{}
+		if err := json.Unmarshal(item, request); err != nil || request.Method == "" {
+			responses[i] = errorResponse(NewError(ErrorInvalidRequest, "Invalid request"))
+			continue
+		}
+
+		handler, release, err := b.admit(request)
+		if err != nil {
+			responses[i] = b.complete(request, started, nil, err)
+			continue
+		}
+
+		wg.Add(1)
+		go func(i int, request *cloudRequest) {
+			defer wg.Done()
+			defer release()
+			result, err := b.run(request, handler)
+			responses[i] = b.complete(request, started, result, err)
+		}(i, request)
+	}
+
+	go func() {
+		wg.Wait()
+		batch := make([]*cloudResponse, 0, len(responses))
+		for _, response := range responses {
+			if response != nil {
+				batch = append(batch, response)
+			}
+		}
+		if len(batch) == 0 {
+			return
+		}
+		data, err := json.Marshal(batch)
+		if err != nil {
+			log.Println("Failed to serialize batch response: ", err)
+			return
+		}
+		b.cloudOutbound.Send("", data)
+	}()
+}
+
+// admit authorizes request and accounts it as in-flight, release must be
+// called once admitted request completes
+func (b *Bridge) admit(request *cloudRequest) (Handler, func(), *Error) {
+	handler, err := b.authorize(request)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	release, err := b.limiter.Acquire(request.Method)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if !b.begin() {
+		release()
+		return nil, nil, NewError(ErrorShuttingDown, "Device is shutting down")
+	}
+
+	return handler, func() {
+		release()
+		b.end()
+	}, nil
+}
+
+// run executes admitted request within its timeout, cloud may cancel it by id
+func (b *Bridge) run(request *cloudRequest, handler Handler) (json.RawMessage, *Error) {
+	ctx, cancel := context.WithTimeout(withUser(b.ctx, request.User), b.timeouts.For(request.Method))
+	defer cancel()
+	if request.Id != nil {
+		b.pending.Add(*request.Id, request.User, cancel)
+		defer b.pending.Remove(*request.Id)
+	}
+
+	return b.idempotent(ctx, request, handler)
+}
+
+// authorize resolves handler for request and checks it against policy and user role
+func (b *Bridge) authorize(request *cloudRequest) (Handler, *Error) {
+	handler, ok := b.handlers[request.Method]
+	if !ok && b.passthroughAllowed(request.Method) {
+		handler, ok = b.forward(request.Method), true
+	}
+	if !ok {
+		return nil, NewError(ErrorMethodNotFound, "Method not found: %s", request.Method)
+	}
+
+	if err := b.policy.Check(request.Method); err != nil {
+		return nil, err
+	}
+
+	if err := b.roles.Check(request.User, request.Method); err != nil {
+		return nil, err
+	}
+
+	return handler, nil
+}
+
+// complete logs and audits completed request and builds its response, it
+// returns nil for notifications
+func (b *Bridge) complete(request *cloudRequest, started time.Time, result json.RawMessage, err *Error) *cloudResponse {
+	if err != nil {
+		log.Println("Call ", request.Method, " failed: ", err)
+	}
+	b.audit.Record(request.Method, request.Params, result, request.User, err, time.Since(started))
+	return respond(request.Id, result, err)
+}
+
+// serve registers typed handler for a method served by the device itself
+func serve[Request interface{}, Response interface{}](method jsonrpc.Method[Request, Response], bridge *Bridge, handler func(ctx context.Context, request *Request) (*Response, *Error)) {
+	bridge.handle(method.Name, func(ctx context.Context, params json.RawMessage) (json.RawMessage, *Error) {
+		request := new(Request)
+		if err := decodeParams(params, request); err != nil {
+			return nil, NewError(ErrorInvalidParams, "Invalid params: %v", err)
+		}
+		response, err := handler(ctx, request)
+		if err != nil {
+			return nil, err
+		}
+		result, marshalErr := json.Marshal(response)
+		if marshalErr != nil {
+			return nil, NewError(ErrorInternal, "Failed to serialize result: %v", marshalErr)
+		}
+		return result, nil
+	})
+}
+
+// respond builds response with result or error, there is none for notifications
+func respond(id *json.RawMessage, result json.RawMessage, err *Error) *cloudResponse {
+	if id == nil {
+		return nil
+	}
+
+	response := &cloudResponse{
+		Jsonrpc: "2.0",
+		Id:      *id,
+	}
+	if err != nil {
+		response.Error = err
+	} else if len(result) == 0 {
+		response.Result = json.RawMessage("null")
+	} else {
+		response.Result = result
+	}
+	return response
+}
+
+// errorResponse reports request which id could not be determined
+func errorResponse(err *Error) *cloudResponse {
+	return &cloudResponse{
+		Jsonrpc: "2.0",
+		Id:      json.RawMessage("null"),
+		Error:   err,
+	}
+}
+
+// send passes response to the cloud, nil response is ignored
+func (b *Bridge) send(response *cloudResponse) {
+	if response == nil {
+		return
+	}
+
+	data, err := json.Marshal(response)
+	if err != nil {
+		log.Println("Failed to serialize response: ", err)
+		return
+	}
+	b.cloudOutbound.Send("", data)
+}
+
+// decodeParams unmarshals request params, missing params leave request zero valued
+func decodeParams(params json.RawMessage, request interface{}) error {
+	if len(params) == 0 || string(params) == "null" {
+		return nil
+	}
+	return json.Unmarshal(params, request)
+}
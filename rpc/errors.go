@@ -0,0 +1,44 @@
+package rpc
+
+import "fmt"
+
+// Standard JSON-RPC 2.0 error codes
+const (
+	ErrorParse          = -32700
+	ErrorInvalidRequest = -32600
+	ErrorMethodNotFound = -32601
+	ErrorInvalidParams  = -32602
+	ErrorInternal       = -32603
+)
+
+// Bridge error codes, Moonraker errors keep their own codes
+const (
+	ErrorPrinterDisconnected = -32001
+	ErrorTimeout             = -32002
+	ErrorShuttingDown        = -32003
+	ErrorCancelled           = -32004
+	ErrorForbidden           = -32005
+	ErrorGCodeRejected       = -32006
+	ErrorKlippyNotReady      = -32007
+	ErrorRateLimited         = -32008
+	ErrorDataCapExceeded     = -32009
+	ErrorOutcomeUnknown      = -32010
+)
+
+// Error is a JSON-RPC error object
+type Error struct {
+	Code    int         `json:"code"`
+	Message string      `json:"message"`
+	Data    interface{} `json:"data,omitempty"`
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("%s (%d)", e.Message, e.Code)
+}
+
+func NewError(code int, format string, args ...interface{}) *Error {
+	return &Error{
+		Code:    code,
+		Message: fmt.Sprintf(format, args...),
+	}
+}
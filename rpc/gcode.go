@@ -0,0 +1,334 @@
+package rpc
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/finomen/go-moonraker-api/api"
+	"klipper-cloud-control-client/config"
+	"log"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	macroObjectPrefix = "gcode_macro "
+	bedHeater         = "HEATER_BED"
+)
+
+// gcodeArgs splits line the same way Klipper does, so packed commands like
+// M104S300 are inspected exactly as Klipper will execute them
+var gcodeArgs = regexp.MustCompile(`([A-Z_]+|[A-Z*/])`)
+
+// gcodeLineNumber matches optional N word Klipper skips before command name
+var gcodeLineNumber = regexp.MustCompile(`^N[0-9]+\s*`)
+
+// extruderHeater matches heater names of extruders
+var extruderHeater = regexp.MustCompile(`^EXTRUDER[0-9]*$`)
+
+type gcodeCommand struct {
+	line   int
+	text   string
+	name   string
+	params map[string]string
+	// malformed is set when arguments can not be parsed, Klipper refuses such command
+	malformed bool
+}
+
+// splitArgs splits extended command arguments like Python shlex.split in
+// POSIX mode which Klipper uses for them: quotes are removed and backslash
+// escapes the next character, inside double quotes only quote and backslash.
+func splitArgs(text string) ([]string, bool) {
+	var fields []string
+	var field strings.Builder
+	inField := false
+	quote := byte(0)
+	for i := 0; i < len(text); i++ {
+		c := text[i]
+		switch {
+		case quote == '\'':
+			if c == quote {
+				quote = 0
+			} else {
+				field.WriteByte(c)
+			}
+		case quote == '"':
+			if c == quote {
+				quote = 0
+			} else if c == '\\' && i+1 < len(text) && (text[i+1] == '"' || text[i+1] == '\\') {
+				i++
+				field.WriteByte(text[i])
+			} else {
+				field.WriteByte(c)
+			}
+		case c == '\\':
+			if i+1 >= len(text) {
+				return nil, false
+			}
+			i++
+			field.WriteByte(text[i])
+			inField = true
+		case c == '\'' || c == '"':
+			quote = c
+			inField = true
+		case c == ' ' || c == '\t' || c == '\r' || c == '\n':
+			if inField {
+				fields = append(fields, field.String())
+				field.Reset()
+				inField = false
+			}
+		default:
+			field.WriteByte(c)
+			inField = true
+		}
+	}
+	if quote != 0 {
+		return nil, false
+	}
+	if inField {
+		fields = append(fields, field.String())
+	}
+	return fields, true
+}
+
+func splitGCodeLine(line string) []string {
+	var parts []string
+	last := 0
+	for _, match := range gcodeArgs.FindAllStringIndex(line, -1) {
+		parts = append(parts, line[last:match[0]], line[match[0]:match[1]])
+		last = match[1]
+	}
+	return append(parts, line[last:])
+}
+
+// parseGCode extracts commands and their parameters from multi-line script
+func parseGCode(script string) []gcodeCommand {
+	var commands []gcodeCommand
+	for i, text := range strings.Split(script, "\n") {
+		line := strings.TrimSpace(text)
+		if pos := strings.IndexByte(line, ';'); pos >= 0 {
+			line = line[:pos]
+		}
+		line = strings.ToUpper(line)
+
+		parts := splitGCodeLine(line)
+		if len(parts) >= 5 && parts[1] == "N" {
+			parts = append(parts[:1], parts[3:]...)
+		}
+		if len(parts) < 3 {
+			continue
+		}
+
+		command := gcodeCommand{
+			line:   i + 1,
+			text:   strings.TrimSpace(text),
+			params: map[string]string{},
+		}
+		if len(parts[1]) > 1 {
+			// Extended command, arguments are KEY=VALUE pairs ending at # or *
+			rest := gcodeLineNumber.ReplaceAllString(line, "")
+			command.name = strings.Fields(rest)[0]
+			args := rest[len(command.name):]
+			if pos := strings.IndexAny(args, "#*"); pos >= 0 {
+				args = args[:pos]
+			}
+			fields, ok := splitArgs(args)
+			command.malformed = !ok
+			for _, field := range fields {
+				if key, value, ok := strings.Cut(field, "="); ok {
+					command.params[key] = value
+				}
+			}
+		} else {
+			command.name = parts[1] + strings.TrimSpace(parts[2])
+			for j := 3; j+1 < len(parts); j += 2 {
+				command.params[parts[j]] = strings.TrimSpace(parts[j+1])
+			}
+		}
+		commands = append(commands, command)
+	}
+	return commands
+}
+
+// GCodeInspector validates remote scripts against configured rules before
+// they are passed to Klipper.
+type GCodeInspector struct {
+	blocked        []string
+	allowedMacros  []string
+	maxExtruder    float64
+	maxBed         float64
+	maxFeedrate    float64
+	enabled        bool
+	mutex          sync.Mutex
+	macros         map[string]struct{}
+	macrosObserved bool
+}
+
+func rejectGCode(command gcodeCommand, format string, args ...interface{}) *Error {
+	err := NewError(ErrorGCodeRejected, "Line %d: %s", command.line, fmt.Sprintf(format, args...))
+	err.Data = map[string]interface{}{
+		"line":    command.line,
+		"command": command.text,
+	}
+	return err
+}
+
+func (g *GCodeInspector) checkLimit(command gcodeCommand, param string, limit float64, what string) *Error {
+	if limit <= 0 {
+		return nil
+	}
+	raw, ok := command.params[param]
+	if !ok {
+		return nil
+	}
+	value, err := strconv.ParseFloat(raw, 64)
+	if err != nil {
+		return rejectGCode(command, "invalid %s value %s", what, raw)
+	}
+	if value > limit {
+		return rejectGCode(command, "%s %g exceeds limit %g", what, value, limit)
+	}
+	return nil
+}
+
+// strictestLimit returns lowest configured limit, zero if none is configured
+func strictestLimit(limits ...float64) float64 {
+	strictest := 0.0
+	for _, limit := range limits {
+		if limit > 0 && (strictest == 0 || limit < strictest) {
+			strictest = limit
+		}
+	}
+	return strictest
+}
+
+func (g *GCodeInspector) checkCommand(command gcodeCommand) *Error {
+	if command.malformed {
+		return rejectGCode(command, "malformed arguments of %s", command.name)
+	}
+	if matchMethod(g.blocked, command.name) {
+		return rejectGCode(command, "command %s is blocked", command.name)
+	}
+
+	if len(g.allowedMacros) > 0 && g.isMacro(command.name) && !matchMethod(g.allowedMacros, command.name) {
+		return rejectGCode(command, "macro %s is not allowed", command.name)
+	}
+
+	switch command.name {
+	case "M104", "M109":
+		if err := g.checkLimit(command, "S", g.maxExtruder, "extruder temperature"); err != nil {
+			return err
+		}
+		return g.checkLimit(command, "R", g.maxExtruder, "extruder temperature")
+	case "M140", "M190":
+		if err := g.checkLimit(command, "S", g.maxBed, "bed temperature"); err != nil {
+			return err
+		}
+		return g.checkLimit(command, "R", g.maxBed, "bed temperature")
+	case "SET_HEATER_TEMPERATURE":
+		heater := command.params["HEATER"]
+		switch {
+		case heater == bedHeater:
+			return g.checkLimit(command, "TARGET", g.maxBed, "bed temperature")
+		case extruderHeater.MatchString(heater):
+			return g.checkLimit(command, "TARGET", g.maxExtruder, "extruder temperature")
+		}
+		// Other heaters get the strictest limit, inspector can't tell what they heat
+		return g.checkLimit(command, "TARGET", strictestLimit(g.maxBed, g.maxExtruder), "heater temperature")
+	case "G0", "G1", "G2", "G3":
+		return g.checkLimit(command, "F", g.maxFeedrate, "feedrate")
+	}
+	return nil
+}
+
+func (g *GCodeInspector) isMacro(name string) bool {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	_, ok := g.macros[name]
+	return ok
+}
+
+// ObserveResult learns macro names from printer objects list
+func (g *GCodeInspector) ObserveResult(method string, result json.RawMessage) {
+	if method != api.PrinterObjectsList.Name {
+		return
+	}
+	response := api.PrinterObjectsListResponse{}
+	if err := json.Unmarshal(result, &response); err != nil {
+		return
+	}
+
+	macros := map[string]struct{}{}
+	for _, object := range response.Objects {
+		if strings.HasPrefix(object, macroObjectPrefix) {
+			macros[strings.ToUpper(strings.TrimPrefix(object, macroObjectPrefix))] = struct{}{}
+		}
+	}
+
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	g.macros = macros
+	g.macrosObserved = true
+}
+
+// Invalidate forgets learned macros, they are listed again before next check.
+// Klippy restart or printer reconnect may bring configuration with other macros.
+func (g *GCodeInspector) Invalidate() {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	g.macrosObserved = false
+}
+
+func (g *GCodeInspector) needMacros() bool {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	return len(g.allowedMacros) > 0 && !g.macrosObserved
+}
+
+// Check validates script, printer is used to learn macro names when needed
+func (g *GCodeInspector) Check(ctx context.Context, script string, printer *RawClient) *Error {
+	if !g.enabled {
+		return nil
+	}
+
+	if g.needMacros() {
+		result, err := printer.Call(ctx, api.PrinterObjectsList.Name, struct{}{})
+		if err != nil {
+			log.Println("Failed to list macros: ", err)
+			return err
+		}
+		g.ObserveResult(api.PrinterObjectsList.Name, result)
+	}
+
+	for _, command := range parseGCode(script) {
+		if err := g.checkCommand(command); err != nil {
+			log.Println("G-code rejected: ", err.Message)
+			return err
+		}
+	}
+	return nil
+}
+
+func upperAll(values []string) []string {
+	result := make([]string, len(values))
+	for i, value := range values {
+		result[i] = strings.ToUpper(value)
+	}
+	return result
+}
+
+func NewGCodeInspector(cfg config.GCodeConfig) *GCodeInspector {
+	inspector := &GCodeInspector{
+		blocked:       upperAll(cfg.BlockedCommands),
+		allowedMacros: upperAll(cfg.AllowedMacros),
+		maxExtruder:   cfg.MaxExtruderTemperature,
+		maxBed:        cfg.MaxBedTemperature,
+		maxFeedrate:   cfg.MaxFeedrate,
+		macros:        map[string]struct{}{},
+	}
+	inspector.enabled = len(inspector.blocked) > 0 || len(inspector.allowedMacros) > 0 ||
+		inspector.maxExtruder > 0 || inspector.maxBed > 0 || inspector.maxFeedrate > 0
+	return inspector
+}
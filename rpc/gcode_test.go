@@ -0,0 +1,159 @@
+package rpc
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/finomen/go-moonraker-api/api"
+	"klipper-cloud-control-client/config"
+	"strings"
+	"testing"
+)
+
+func TestParseGCodeLineNumber(t *testing.T) {
+	tests := []struct {
+		script string
+		name   string
+		params map[string]string
+	}{
+		{"N10 SAVE_CONFIG", "SAVE_CONFIG", map[string]string{}},
+		{"N1 SET_HEATER_TEMPERATURE HEATER=extruder TARGET=400", "SET_HEATER_TEMPERATURE",
+			map[string]string{"HEATER": "EXTRUDER", "TARGET": "400"}},
+		{"N7 M104 S300", "M104", map[string]string{"S": "300"}},
+		{"N7M104S300", "M104", map[string]string{"S": "300"}},
+	}
+
+	for _, test := range tests {
+		commands := parseGCode(test.script)
+		if len(commands) != 1 {
+			t.Fatalf("%q: parsed %d commands", test.script, len(commands))
+		}
+		command := commands[0]
+		if command.name != test.name {
+			t.Errorf("%q: name %q, want %q", test.script, command.name, test.name)
+		}
+		for key, value := range test.params {
+			if command.params[key] != value {
+				t.Errorf("%q: param %s is %q, want %q", test.script, key, command.params[key], value)
+			}
+		}
+	}
+}
+
+func TestGCodeCheckLineNumber(t *testing.T) {
+	inspector := NewGCodeInspector(config.GCodeConfig{
+		BlockedCommands:        []string{"SAVE_CONFIG"},
+		MaxExtruderTemperature: 280,
+	})
+
+	scripts := []string{
+		"N10 SAVE_CONFIG",
+		"N1 SET_HEATER_TEMPERATURE HEATER=extruder TARGET=400",
+		"G28\nN2 M104 S300",
+	}
+	for _, script := range scripts {
+		err := inspector.Check(context.Background(), script, nil)
+		if err == nil {
+			t.Errorf("%q: accepted", script)
+			continue
+		}
+		if err.Code != ErrorGCodeRejected {
+			t.Errorf("%q: code %d, want %d", script, err.Code, ErrorGCodeRejected)
+		}
+	}
+
+	if err := inspector.Check(context.Background(), "N3 SET_HEATER_TEMPERATURE HEATER=extruder TARGET=210", nil); err != nil {
+		t.Errorf("valid script rejected: %s", err.Message)
+	}
+}
+
+func TestSplitArgs(t *testing.T) {
+	tests := []struct {
+		text   string
+		fields []string
+	}{
+		{` HEATER="heater_bed" TARGET=250`, []string{"HEATER=heater_bed", "TARGET=250"}},
+		{`HEATER='heater_bed'`, []string{"HEATER=heater_bed"}},
+		{`HEATER=heater\_bed`, []string{"HEATER=heater_bed"}},
+		{`HEATER=he"ater_"bed`, []string{"HEATER=heater_bed"}},
+		{`MSG="a \"b\" \c" X='\n'`, []string{`MSG=a "b" \c`, `X=\n`}},
+		{`A=1   B=2`, []string{"A=1", "B=2"}},
+	}
+	for _, test := range tests {
+		fields, ok := splitArgs(test.text)
+		if !ok {
+			t.Errorf("%q: not split", test.text)
+			continue
+		}
+		if strings.Join(fields, "|") != strings.Join(test.fields, "|") {
+			t.Errorf("%q: got %q, want %q", test.text, fields, test.fields)
+		}
+	}
+
+	for _, broken := range []string{`HEATER="heater_bed`, `HEATER='x`, `HEATER=x\`} {
+		if _, ok := splitArgs(broken); ok {
+			t.Errorf("%q: split", broken)
+		}
+	}
+}
+
+func TestGCodeCheckQuotedHeater(t *testing.T) {
+	inspector := NewGCodeInspector(config.GCodeConfig{
+		MaxBedTemperature:      110,
+		MaxExtruderTemperature: 300,
+	})
+
+	rejected := []string{
+		`SET_HEATER_TEMPERATURE HEATER="heater_bed" TARGET=250`,
+		`SET_HEATER_TEMPERATURE HEATER='heater_bed' TARGET=250`,
+		`SET_HEATER_TEMPERATURE HEATER=heater\_bed TARGET=250`,
+		`SET_HEATER_TEMPERATURE HEATER=heater_bed TARGET="250"`,
+		`SET_HEATER_TEMPERATURE HEATER="heater_bed TARGET=250`,
+		// Unknown heaters are held to the strictest limit
+		`SET_HEATER_TEMPERATURE HEATER=chamber TARGET=250`,
+		`SET_HEATER_TEMPERATURE HEATER="heater\_bed" TARGET=250`,
+		`SET_HEATER_TEMPERATURE HEATER=extruder1 TARGET=310`,
+		"M140 S250",
+	}
+	for _, script := range rejected {
+		if err := inspector.Check(context.Background(), script, nil); err == nil {
+			t.Errorf("%q: accepted", script)
+		}
+	}
+
+	accepted := []string{
+		`SET_HEATER_TEMPERATURE HEATER="extruder" TARGET=250`,
+		`SET_HEATER_TEMPERATURE HEATER='heater_bed' TARGET=100`,
+		`SET_HEATER_TEMPERATURE HEATER=chamber TARGET=60`,
+		`SET_HEATER_TEMPERATURE HEATER=heater_bed TARGET=60 # TARGET=250`,
+	}
+	for _, script := range accepted {
+		if err := inspector.Check(context.Background(), script, nil); err != nil {
+			t.Errorf("%q: rejected: %s", script, err.Message)
+		}
+	}
+
+	// Bed limit still applies to unknown heaters when extruder limit is not set
+	inspector = NewGCodeInspector(config.GCodeConfig{MaxBedTemperature: 110})
+	if err := inspector.Check(context.Background(), `SET_HEATER_TEMPERATURE HEATER="heater_bed" TARGET=250`, nil); err == nil {
+		t.Error("quoted bed heater accepted without extruder limit")
+	}
+}
+
+func TestGCodeMacrosInvalidate(t *testing.T) {
+	inspector := NewGCodeInspector(config.GCodeConfig{AllowedMacros: []string{"PRINT_*"}})
+	inspector.ObserveResult(api.PrinterObjectsList.Name, json.RawMessage(`{"objects":["gcode_macro PRINT_START"]}`))
+	if inspector.needMacros() {
+		t.Fatal("macros listed again before invalidation")
+	}
+
+	// Macro added to printer.cfg is loaded by restart
+	inspector.Invalidate()
+	if !inspector.needMacros() {
+		t.Fatal("macros are not listed again after invalidation")
+	}
+	inspector.ObserveResult(api.PrinterObjectsList.Name,
+		json.RawMessage(`{"objects":["gcode_macro PRINT_START","gcode_macro PURGE"]}`))
+	if err := inspector.Check(context.Background(), "PURGE", nil); err == nil {
+		t.Error("macro loaded after restart is not checked against allowed macros")
+	}
+}
@@ -0,0 +1,192 @@
+package rpc
+
+import (
+	"bytes"
+	"encoding/json"
+)
+
+// rawHeader holds members of jsonrpc message found by scanHeader, they are
+// slices of the message and are not decoded
+type rawHeader struct {
+	// Method is the method name without quotes
+	Method []byte
+	// Id is nil if message has no id or it is null
+	Id     []byte
+	Params []byte
+}
+
+// notification reports whether message is a jsonrpc notification
+func (h rawHeader) notification() bool {
+	return len(h.Method) > 0 && h.Id == nil
+}
+
+// scanHeader locates method, id and params members of jsonrpc object by
+// walking its top level only, nested values are skipped without decoding.
+// Message is not validated beyond that, it reports false for anything that
+// is not an object, batches included.
+func scanHeader(data []byte) (rawHeader, bool) {
+	header := rawHeader{}
+	i := skipSpace(data, 0)
+	if i >= len(data) || data[i] != '{' {
+		return header, false
+	}
+	i = skipSpace(data, i+1)
+	if i < len(data) && data[i] == '}' {
+		return header, true
+	}
+
+	for i < len(data) {
+		keyEnd, ok := skipString(data, i)
+		if !ok {
+			return header, false
+		}
+		key := data[i+1 : keyEnd-1]
+		i = skipSpace(data, keyEnd)
+		if i >= len(data) || data[i] != ':' {
+			return header, false
+		}
+		i = skipSpace(data, i+1)
+		valueEnd, ok := skipValue(data, i)
+		if !ok {
+			return header, false
+		}
+		value := data[i:valueEnd]
+
+		switch string(key) {
+		case "method":
+			if value[0] != '"' {
+				return header, false
+			}
+			header.Method = value[1 : len(value)-1]
+			if bytes.IndexByte(header.Method, '\\') >= 0 {
+				var method string
+				if err := json.Unmarshal(value, &method); err != nil {
+					return header, false
+				}
+				header.Method = []byte(method)
+			}
+		case "id":
+			if string(value) != "null" {
+				header.Id = value
+			}
+		case "params":
+			header.Params = value
+		}
+
+		i = skipSpace(data, valueEnd)
+		if i >= len(data) {
+			return header, false
+		}
+		if data[i] == '}' {
+			return header, true
+		}
+		if data[i] != ',' {
+			return header, false
+		}
+		i = skipSpace(data, i+1)
+	}
+	return header, false
+}
+
+// splitArray returns elements of JSON array as slices of data without decoding them
+func splitArray(data []byte) ([][]byte, bool) {
+	i := skipSpace(data, 0)
+	if i >= len(data) || data[i] != '[' {
+		return nil, false
+	}
+	var elements [][]byte
+	i = skipSpace(data, i+1)
+	if i < len(data) && data[i] == ']' {
+		return elements, true
+	}
+	for i < len(data) {
+		end, ok := skipValue(data, i)
+		if !ok {
+			return nil, false
+		}
+		elements = append(elements, data[i:end])
+		i = skipSpace(data, end)
+		if i >= len(data) {
+			return nil, false
+		}
+		if data[i] == ']' {
+			return elements, true
+		}
+		if data[i] != ',' {
+			return nil, false
+		}
+		i = skipSpace(data, i+1)
+	}
+	return nil, false
+}
+
+func skipSpace(data []byte, i int) int {
+	for i < len(data) && (data[i] == ' ' || data[i] == '\t' || data[i] == '\r' || data[i] == '\n') {
+		i++
+	}
+	return i
+}
+
+// skipString returns position after string starting at i
+func skipString(data []byte, i int) (int, bool) {
+	if i >= len(data) || data[i] != '"' {
+		return i, false
+	}
+	for i++; i < len(data); i++ {
+		switch data[i] {
+		case '\\':
+			i++
+		case '"':
+			return i + 1, true
+		}
+	}
+	return i, false
+}
+
+// skipValue returns position after value starting at i
+func skipValue(data []byte, i int) (int, bool) {
+	if i >= len(data) {
+		return i, false
+	}
+	switch data[i] {
+	case '"':
+		return skipString(data, i)
+	case '{', '[':
+		depth := 0
+		for i < len(data) {
+			switch data[i] {
+			case '"':
+				end, ok := skipString(data, i)
+				if !ok {
+					return end, false
+				}
+				i = end
+				continue
+			case '{', '[':
+				depth++
+			case '}', ']':
+				depth--
+				if depth == 0 {
+					return i + 1, true
+				}
+			}
+			i++
+		}
+		return i, false
+	default:
+		// Number, literal, or garbage which is left for the decoder to reject
+		start := i
+		for i < len(data) && !isDelimiter(data[i]) {
+			i++
+		}
+		return i, i > start
+	}
+}
+
+func isDelimiter(c byte) bool {
+	switch c {
+	case ',', '}', ']', ' ', '\t', '\r', '\n':
+		return true
+	}
+	return false
+}
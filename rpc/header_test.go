@@ -0,0 +1,73 @@
+package rpc
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestScanHeader(t *testing.T) {
+	tests := []struct {
+		data         string
+		ok           bool
+		method       string
+		id           string
+		params       string
+		notification bool
+	}{
+		{`{"jsonrpc":"2.0","method":"notify_status_update","params":[{"a":{"b":"}]"}},1.5]}`,
+			true, "notify_status_update", "", `[{"a":{"b":"}]"}},1.5]`, true},
+		{` { "id" : 7 , "result" : {"x":[1,2,"\""]} } `, true, "", "7", "", false},
+		{`{"method":"printer.info","id":null,"params":{}}`, true, "printer.info", "", `{}`, true},
+		{`{"method":"printer.info","id":"abc"}`, true, "printer.info", `"abc"`, "", false},
+		{`{"method":"a.b"}`, true, "a.b", "", "", true},
+		{`{}`, true, "", "", "", false},
+		{`[{"method":"a"}]`, false, "", "", "", false},
+		{`{"method":1}`, false, "", "", "", false},
+		{`{"method":"a"`, false, "", "", "", false},
+		{`{"params":[1,2}`, false, "", "", "", false},
+		{`not json`, false, "", "", "", false},
+	}
+
+	for _, test := range tests {
+		header, ok := scanHeader([]byte(test.data))
+		if ok != test.ok {
+			t.Errorf("%s: ok %v, want %v", test.data, ok, test.ok)
+			continue
+		}
+		if !ok {
+			continue
+		}
+		if string(header.Method) != test.method || string(header.Id) != test.id || string(header.Params) != test.params {
+			t.Errorf("%s: got method %q id %q params %q", test.data, header.Method, header.Id, header.Params)
+		}
+		if header.notification() != test.notification {
+			t.Errorf("%s: notification %v, want %v", test.data, header.notification(), test.notification)
+		}
+	}
+}
+
+func TestSplitArray(t *testing.T) {
+	data := []byte(` [ {"a":[1,{"b":"],"}]} , 1893.04, "x" ,null ] `)
+	elements, ok := splitArray(data)
+	if !ok {
+		t.Fatal("array not split")
+	}
+	want := []string{`{"a":[1,{"b":"],"}]}`, `1893.04`, `"x"`, `null`}
+	if len(elements) != len(want) {
+		t.Fatalf("got %d elements, want %d", len(elements), len(want))
+	}
+	for i, element := range elements {
+		if string(element) != want[i] || !json.Valid(element) {
+			t.Errorf("element %d is %s, want %s", i, element, want[i])
+		}
+	}
+
+	if elements, ok := splitArray([]byte(`[]`)); !ok || len(elements) != 0 {
+		t.Errorf("empty array: %v %v", elements, ok)
+	}
+	for _, broken := range []string{`{}`, `[1,`, `[1 2]`} {
+		if _, ok := splitArray([]byte(broken)); ok {
+			t.Errorf("%s: split", broken)
+		}
+	}
+}
@@ -0,0 +1,197 @@
+package rpc
+
+import (
+	"context"
+	"encoding/json"
+	"klipper-cloud-control-client/config"
+	"log"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultIdempotencyPath       = "idempotency.jsonl"
+	DefaultIdempotencyMaxEntries = 1000
+	DefaultIdempotencyMaxAge     = 24 * time.Hour
+)
+
+type IdempotencyEntry struct {
+	Key    string          `json:"key"`
+	Method string          `json:"method"`
+	Time   time.Time       `json:"time"`
+	Result json.RawMessage `json:"result"`
+	// Error is set when original call timed out or was cancelled, it may or
+	// may not have been executed by the printer
+	Error *Error `json:"error,omitempty"`
+}
+
+// idempotentCall is a call in progress, duplicates wait for its outcome
+type idempotentCall struct {
+	done   chan struct{}
+	result json.RawMessage
+	err    *Error
+}
+
+// Idempotency remembers results of mutating calls by idempotency key, so
+// requests retried by the cloud after reconnect are not executed twice.
+// Successful results are kept, calls which timed out or were cancelled are
+// kept as outcome unknown, other failed calls may be retried. Entries are
+// appended to a JSONL file to survive restarts.
+type Idempotency struct {
+	mutex   sync.Mutex
+	store   *jsonlStore[IdempotencyEntry]
+	results map[string]IdempotencyEntry
+	pending map[string]*idempotentCall
+}
+
+// isMutating reports whether method may change printer or host state
+func isMutating(method string) bool {
+	return !matchMethod(policyPresets[PresetReadOnly].allow, method)
+}
+
+// idempotent runs handler once per idempotency key of mutating request
+func (b *Bridge) idempotent(ctx context.Context, request *cloudRequest, handler Handler) (json.RawMessage, *Error) {
+	if request.IdempotencyKey == "" || !isMutating(request.Method) {
+		return handler(ctx, request.Params)
+	}
+
+	// Keys are scoped by user, so results are never disclosed to another user
+	key := request.IdempotencyKey
+	if request.User != nil {
+		key = request.User.Id + "/" + key
+	}
+
+	result, call, err := b.idempotency.Begin(key, request.Method)
+	if err != nil {
+		return nil, err
+	}
+	if result != nil {
+		log.Println("Duplicate ", request.Method, " request, returning original result")
+		return result, nil
+	}
+	if call != nil {
+		select {
+		case <-call.done:
+			return call.result, call.err
+		case <-ctx.Done():
+			return nil, contextError(ctx)
+		}
+	}
+
+	result, err = handler(ctx, request.Params)
+	b.idempotency.Complete(key, request.Method, result, err)
+	return result, err
+}
+
+// Begin looks up key, it returns stored result of completed call, call in
+// progress to wait for, or neither if caller has to execute the request
+func (i *Idempotency) Begin(key string, method string) (json.RawMessage, *idempotentCall, *Error) {
+	i.mutex.Lock()
+	defer i.mutex.Unlock()
+
+	i.store.trim(time.Now())
+
+	if entry, ok := i.results[key]; ok {
+		if entry.Method != method {
+			return nil, nil, NewError(ErrorInvalidRequest, "Idempotency key was used for %s", entry.Method)
+		}
+		if entry.Error != nil {
+			return nil, nil, entry.Error
+		}
+		return entry.Result, nil, nil
+	}
+	if call, ok := i.pending[key]; ok {
+		return nil, call, nil
+	}
+
+	i.pending[key] = &idempotentCall{
+		done: make(chan struct{}),
+	}
+	return nil, nil, nil
+}
+
+// outcomeUnknown reports whether failed call might still have been executed
+func outcomeUnknown(err *Error) bool {
+	return err.Code == ErrorTimeout || err.Code == ErrorCancelled
+}
+
+// Complete stores result of call and releases duplicates waiting for it.
+// Timed out and cancelled calls are stored as outcome unknown, so retry with
+// the same key does not execute request again.
+func (i *Idempotency) Complete(key string, method string, result json.RawMessage, err *Error) {
+	i.mutex.Lock()
+	defer i.mutex.Unlock()
+
+	entry := IdempotencyEntry{
+		Key:    key,
+		Method: method,
+		Time:   time.Now(),
+		Result: result,
+	}
+	if err != nil && outcomeUnknown(err) {
+		entry.Result = nil
+		entry.Error = NewError(ErrorOutcomeUnknown, "Outcome of %s is unknown, retry with new idempotency key", method)
+		entry.Error.Data = err
+		// Duplicates waiting for the call are answered as later retries would be
+		err = entry.Error
+	}
+
+	if call, ok := i.pending[key]; ok {
+		call.result = result
+		call.err = err
+		close(call.done)
+		delete(i.pending, key)
+	}
+	if err != nil && entry.Error == nil {
+		return
+	}
+	if err == nil && len(result) == 0 {
+		entry.Result = json.RawMessage("null")
+	}
+
+	i.results[key] = entry
+	i.store.Append(entry)
+}
+
+func (i *Idempotency) Close() {
+	i.mutex.Lock()
+	defer i.mutex.Unlock()
+	i.store.Close()
+}
+
+func NewIdempotency(cfg config.IdempotencyConfig) *Idempotency {
+	idempotency := &Idempotency{
+		results: map[string]IdempotencyEntry{},
+		pending: map[string]*idempotentCall{},
+	}
+	store := &jsonlStore[IdempotencyEntry]{
+		name:       "idempotency store",
+		path:       cfg.Path,
+		maxEntries: cfg.MaxEntries,
+		maxAge:     cfg.MaxAge,
+		timeOf: func(entry IdempotencyEntry) time.Time {
+			return entry.Time
+		},
+		evicted: func(entry IdempotencyEntry) {
+			if idempotency.results[entry.Key].Time.Equal(entry.Time) {
+				delete(idempotency.results, entry.Key)
+			}
+		},
+	}
+	if store.path == "" {
+		store.path = DefaultIdempotencyPath
+	}
+	if store.maxEntries <= 0 {
+		store.maxEntries = DefaultIdempotencyMaxEntries
+	}
+	if store.maxAge <= 0 {
+		store.maxAge = DefaultIdempotencyMaxAge
+	}
+
+	idempotency.store = store
+	store.load(func(entry IdempotencyEntry) {
+		idempotency.results[entry.Key] = entry
+	})
+
+	return idempotency
+}
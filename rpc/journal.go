@@ -0,0 +1,159 @@
+package rpc
+
+import (
+	"encoding/json"
+	"github.com/finomen/go-moonraker-api/jsonrpc"
+	"klipper-cloud-control-client/config"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultJournalPath       = "journal.jsonl"
+	DefaultJournalMaxEntries = 10000
+	DefaultJournalMaxAge     = 24 * time.Hour
+	DefaultJournalMaxBytes   = 8 << 20
+	DefaultJournalPageSize   = 500
+	MaxJournalPageSize       = 5000
+)
+
+type JournalEntry struct {
+	Seq    uint64          `json:"seq"`
+	Time   time.Time       `json:"time"`
+	Method string          `json:"method"`
+	Params json.RawMessage `json:"params"`
+}
+
+type JournalSinceRequest struct {
+	Seq uint64 `json:"seq"`
+	// Limit caps number of returned entries, DefaultJournalPageSize when zero
+	Limit int `json:"limit,omitempty"`
+}
+
+type JournalSinceResponse struct {
+	Entries []JournalEntry `json:"entries"`
+	// LastSeq is the latest sequence number known to the device
+	LastSeq uint64 `json:"last_seq"`
+	// Truncated is set when entries after requested seq were already evicted,
+	// or seq is ahead of LastSeq because journal was reset
+	Truncated bool `json:"truncated"`
+	// More is set when page is full and further entries remain, request
+	// again starting from seq of the last returned entry
+	More bool `json:"more"`
+}
+
+// JournalSince lets cloud fetch notifications it missed while disconnected
+var JournalSince = jsonrpc.Method[JournalSinceRequest, JournalSinceResponse]{Name: "kcc.journal.since"}
+
+// Journal keeps a bounded history of notifications forwarded to the cloud.
+// Entries are appended to a JSONL file so sequence numbers survive restarts.
+type Journal struct {
+	mutex sync.Mutex
+	store *jsonlStore[JournalEntry]
+	seq   uint64
+}
+
+// Append stamps notification with next sequence number and stores it
+func (j *Journal) Append(method string, params json.RawMessage) JournalEntry {
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+
+	j.seq++
+	entry := JournalEntry{
+		Seq:    j.seq,
+		Time:   time.Now(),
+		Method: method,
+		Params: params,
+	}
+	j.store.Append(entry)
+	return entry
+}
+
+// Since returns up to limit retained entries with sequence number greater than seq
+func (j *Journal) Since(seq uint64, limit int) JournalSinceResponse {
+	if limit <= 0 {
+		limit = DefaultJournalPageSize
+	}
+	if limit > MaxJournalPageSize {
+		limit = MaxJournalPageSize
+	}
+
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+
+	j.store.trim(time.Now())
+	entries := j.store.entries
+
+	response := JournalSinceResponse{
+		Entries: []JournalEntry{},
+		LastSeq: j.seq,
+	}
+	// Entries are ordered by seq, so first newer one is found by binary search
+	start := sort.Search(len(entries), func(i int) bool {
+		return entries[i].Seq > seq
+	})
+	end := start + limit
+	if end < len(entries) {
+		response.More = true
+	} else {
+		end = len(entries)
+	}
+	response.Entries = append(response.Entries, entries[start:end]...)
+	if seq < j.seq {
+		if len(response.Entries) == 0 || response.Entries[0].Seq > seq+1 {
+			response.Truncated = true
+		}
+	}
+	// Cloud is ahead of the journal, it was reset and history is lost
+	if seq > j.seq {
+		response.Truncated = true
+	}
+	return response
+}
+
+func (j *Journal) LastSeq() uint64 {
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+	return j.seq
+}
+
+func (j *Journal) Close() {
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+	j.store.Close()
+}
+
+func NewJournal(cfg config.JournalConfig) *Journal {
+	store := &jsonlStore[JournalEntry]{
+		name:       "journal",
+		path:       cfg.Path,
+		maxEntries: cfg.MaxEntries,
+		maxAge:     cfg.MaxAge,
+		maxBytes:   cfg.MaxBytes,
+		timeOf: func(entry JournalEntry) time.Time {
+			return entry.Time
+		},
+	}
+	if store.path == "" {
+		store.path = DefaultJournalPath
+	}
+	if store.maxEntries <= 0 {
+		store.maxEntries = DefaultJournalMaxEntries
+	}
+	if store.maxAge <= 0 {
+		store.maxAge = DefaultJournalMaxAge
+	}
+	if store.maxBytes <= 0 {
+		store.maxBytes = DefaultJournalMaxBytes
+	}
+
+	journal := &Journal{store: store}
+	store.load(func(entry JournalEntry) {
+		if entry.Seq > journal.seq {
+			journal.seq = entry.Seq
+		}
+	})
+
+	return journal
+}
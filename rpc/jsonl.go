@@ -0,0 +1,177 @@
+package rpc
+
+import (
+	"bufio"
+	"encoding/json"
+	"log"
+	"os"
+	"time"
+)
+
+// jsonlStore keeps bounded list of entries mirrored to append-only JSONL
+// file, so they survive restarts. File is compacted to retained entries once
+// it grows twice over the bounds. Store is not synchronized, owner calls it
+// under its own lock.
+type jsonlStore[T any] struct {
+	// name is used in log messages
+	name string
+	path string
+	file *os.File
+
+	entries []T
+	// sizes are encoded lengths of entries, bytes is their sum
+	sizes []int
+	bytes int
+
+	maxEntries int
+	maxAge     time.Duration
+	// maxBytes bounds retained entries by encoded size, zero means no bound
+	maxBytes int
+
+	// written and wrote count entries and bytes in file since last compaction
+	written int
+	wrote   int
+
+	timeOf func(entry T) time.Time
+	// evicted is called for entries removed by trim, it may be nil
+	evicted func(entry T)
+}
+
+// load reads entries from file, restored is called for each of them before trim
+func (s *jsonlStore[T]) load(restored func(entry T)) {
+	file, err := os.Open(s.path)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Println("Failed to open ", s.name, ": ", err)
+		}
+		return
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 0, 64*1024), MaxMessageSize)
+	for scanner.Scan() {
+		var entry T
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			log.Println("Skip broken ", s.name, " entry: ", err)
+			continue
+		}
+		size := len(scanner.Bytes()) + 1
+		s.entries = append(s.entries, entry)
+		s.sizes = append(s.sizes, size)
+		s.bytes += size
+		s.written++
+		s.wrote += size
+		if restored != nil {
+			restored(entry)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		log.Println("Failed to read ", s.name, ": ", err)
+	}
+	s.trim(time.Now())
+}
+
+func (s *jsonlStore[T]) overflow(retained int) bool {
+	return retained > s.maxEntries || (s.maxBytes > 0 && s.bytes > s.maxBytes)
+}
+
+// trim evicts entries exceeding count, byte and age bounds
+func (s *jsonlStore[T]) trim(now time.Time) {
+	start := 0
+	for start < len(s.entries) {
+		entry := s.entries[start]
+		if !s.overflow(len(s.entries)-start) && now.Sub(s.timeOf(entry)) <= s.maxAge {
+			break
+		}
+		s.bytes -= s.sizes[start]
+		if s.evicted != nil {
+			s.evicted(entry)
+		}
+		start++
+	}
+	s.entries = s.entries[start:]
+	s.sizes = s.sizes[start:]
+}
+
+// compact rewrites file with retained entries only
+func (s *jsonlStore[T]) compact() error {
+	if s.file != nil {
+		s.file.Close()
+		s.file = nil
+	}
+
+	tmpPath := s.path + ".tmp"
+	tmp, err := os.OpenFile(tmpPath, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	writer := bufio.NewWriter(tmp)
+	encoder := json.NewEncoder(writer)
+	for _, entry := range s.entries {
+		if err := encoder.Encode(entry); err != nil {
+			tmp.Close()
+			return err
+		}
+	}
+	if err := writer.Flush(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmpPath, s.path); err != nil {
+		return err
+	}
+	s.written = len(s.entries)
+	s.wrote = s.bytes
+	return nil
+}
+
+// write appends entry to file and returns its encoded size
+func (s *jsonlStore[T]) write(entry T) (int, error) {
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return 0, err
+	}
+	size := len(data) + 1
+	if s.file == nil {
+		file, err := os.OpenFile(s.path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+		if err != nil {
+			return size, err
+		}
+		s.file = file
+	}
+	if _, err := s.file.Write(append(data, '\n')); err != nil {
+		return size, err
+	}
+	s.written++
+	s.wrote += size
+	return size, nil
+}
+
+// Append stores entry in memory and file, then applies bounds
+func (s *jsonlStore[T]) Append(entry T) {
+	size, err := s.write(entry)
+	if err != nil {
+		log.Println("Failed to write ", s.name, ": ", err)
+	}
+	s.entries = append(s.entries, entry)
+	s.sizes = append(s.sizes, size)
+	s.bytes += size
+	s.trim(s.timeOf(entry))
+
+	if s.written > 2*s.maxEntries || (s.maxBytes > 0 && s.wrote > 2*s.maxBytes) {
+		if err := s.compact(); err != nil {
+			log.Println("Failed to compact ", s.name, ": ", err)
+		}
+	}
+}
+
+func (s *jsonlStore[T]) Close() {
+	if s.file != nil {
+		s.file.Close()
+		s.file = nil
+	}
+}
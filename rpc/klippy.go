@@ -0,0 +1,122 @@
+package rpc
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/finomen/go-moonraker-api/api"
+	"log"
+	"strings"
+	"time"
+)
+
+// klippyExempt are printer methods Moonraker serves regardless of Klippy state,
+// they are needed to inspect and recover Klippy
+var klippyExempt = map[string]struct{}{
+	api.PrinterInfo.Name:            {},
+	api.PrinterRestart.Name:         {},
+	api.PrinterFirmwareRestart.Name: {},
+	api.PrinterEmergencyStop.Name:   {},
+}
+
+// klippyRecovery are printer methods Klipper still serves in shutdown and
+// error states, cloud reads shutdown reason from status objects with them
+var klippyRecovery = map[string]struct{}{
+	api.PrinterObjectsQuery.Name:     {},
+	api.PrinterObjectsSubscribe.Name: {},
+}
+
+// recoveryCommands are G-code commands Klipper executes in shutdown and error states
+var recoveryCommands = map[string]struct{}{
+	"FIRMWARE_RESTART": {},
+	"RESTART":          {},
+	"STATUS":           {},
+}
+
+func requiresKlippy(method string) bool {
+	if !strings.HasPrefix(method, "printer.") {
+		return false
+	}
+	_, exempt := klippyExempt[method]
+	return !exempt
+}
+
+// klippyAllows reports whether method can be served in Klippy state. Klipper
+// is unusable in startup and disconnected states, while shutdown and error
+// states still allow object queries and restart commands.
+func klippyAllows(state string, method string, params json.RawMessage) bool {
+	switch state {
+	case KlippyReady, "":
+		return true
+	case KlippyShutdown, KlippyError:
+	default:
+		return false
+	}
+
+	if _, ok := klippyRecovery[method]; ok {
+		return true
+	}
+	if method != api.PrinterGCodeScript.Name {
+		return false
+	}
+	var request api.PrinterGCodeScriptRequest
+	if err := decodeParams(params, &request); err != nil {
+		return false
+	}
+	commands := parseGCode(request.Script)
+	for _, command := range commands {
+		if _, ok := recoveryCommands[command.name]; !ok || command.malformed {
+			return false
+		}
+	}
+	return len(commands) > 0
+}
+
+// refreshKlippyState queries Klippy state, Moonraker does not notify about
+// startup and error states
+func (b *Bridge) refreshKlippyState(ctx context.Context) {
+	result, err := b.printer.Call(ctx, api.PrinterInfo.Name, struct{}{})
+	if err != nil {
+		log.Println("Failed to refresh klippy state: ", err)
+		return
+	}
+	b.observe(api.PrinterInfo.Name, result)
+}
+
+// awaitKlippy rejects printer.* call Klippy can not serve in its state, the
+// call is held for configured window waiting for Klippy to become ready
+func (b *Bridge) awaitKlippy(ctx context.Context, method string, params json.RawMessage) *Error {
+	if !requiresKlippy(method) || !b.state.PrinterConnected() {
+		return nil
+	}
+
+	state, _ := b.state.KlippyState()
+	if klippyAllows(state, method, params) {
+		return nil
+	}
+
+	b.refreshKlippyState(ctx)
+	if b.klippyWait > 0 {
+		wait := time.NewTimer(b.klippyWait)
+		select {
+		case <-b.state.Ready():
+		case <-wait.C:
+		case <-ctx.Done():
+		}
+		wait.Stop()
+	}
+
+	state, message := b.state.KlippyState()
+	if klippyAllows(state, method, params) {
+		return nil
+	}
+	if ctx.Err() != nil {
+		return contextError(ctx)
+	}
+
+	err := NewError(ErrorKlippyNotReady, "Klippy is not ready: %s", state)
+	err.Data = map[string]interface{}{
+		"klippy_state":  state,
+		"state_message": message,
+	}
+	return err
+}
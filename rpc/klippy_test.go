@@ -0,0 +1,40 @@
+package rpc
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestKlippyAllows(t *testing.T) {
+	script := func(text string) json.RawMessage {
+		data, _ := json.Marshal(map[string]string{"script": text})
+		return data
+	}
+	tests := []struct {
+		state  string
+		method string
+		params json.RawMessage
+		allow  bool
+	}{
+		{KlippyReady, "printer.print.start", nil, true},
+		{"", "printer.print.start", nil, true},
+		{KlippyStartup, "printer.objects.query", nil, false},
+		{KlippyDisconnected, "printer.objects.subscribe", nil, false},
+		{KlippyShutdown, "printer.objects.query", nil, true},
+		{KlippyError, "printer.objects.subscribe", nil, true},
+		{KlippyShutdown, "printer.print.start", nil, false},
+		{KlippyShutdown, "printer.gcode.script", script("FIRMWARE_RESTART"), true},
+		{KlippyError, "printer.gcode.script", script("status\nRESTART ; reload config"), true},
+		{KlippyShutdown, "printer.gcode.script", script("FIRMWARE_RESTART\nG28"), false},
+		{KlippyShutdown, "printer.gcode.script", script("; comment only"), false},
+		{KlippyShutdown, "printer.gcode.script", script(`RESTART X="`), false},
+		{KlippyStartup, "printer.gcode.script", script("FIRMWARE_RESTART"), false},
+		{KlippyShutdown, "printer.gcode.script", json.RawMessage(`[1]`), false},
+	}
+
+	for _, test := range tests {
+		if allow := klippyAllows(test.state, test.method, test.params); allow != test.allow {
+			t.Errorf("%s %s %s: allow %v, want %v", test.state, test.method, test.params, allow, test.allow)
+		}
+	}
+}
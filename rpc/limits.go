@@ -0,0 +1,212 @@
+package rpc
+
+import (
+	"github.com/finomen/go-moonraker-api/jsonrpc"
+	"klipper-cloud-control-client/config"
+	"math"
+	"sync"
+	"time"
+)
+
+type tokenBucket struct {
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func (t *tokenBucket) refill(now time.Time) {
+	t.tokens = math.Min(t.burst, t.tokens+now.Sub(t.last).Seconds()*t.rate)
+	t.last = now
+}
+
+// wait returns time until a token is available, zero if it is available now
+func (t *tokenBucket) wait(now time.Time) time.Duration {
+	t.refill(now)
+	if t.tokens >= 1 {
+		return 0
+	}
+	return time.Duration((1 - t.tokens) / t.rate * float64(time.Second))
+}
+
+func newTokenBucket(rate float64, burst int) *tokenBucket {
+	if rate <= 0 {
+		return nil
+	}
+	size := float64(burst)
+	if size < 1 {
+		size = math.Max(1, rate)
+	}
+	return &tokenBucket{
+		rate:   rate,
+		burst:  size,
+		tokens: size,
+		last:   time.Now(),
+	}
+}
+
+type limit struct {
+	bucket      *tokenBucket
+	concurrency int
+	inFlight    int
+}
+
+func (l *limit) checkConcurrency() *Error {
+	if l.concurrency > 0 && l.inFlight >= l.concurrency {
+		err := NewError(ErrorRateLimited, "Too many concurrent requests")
+		err.Data = map[string]interface{}{
+			"concurrency": l.concurrency,
+		}
+		return err
+	}
+	return nil
+}
+
+func (l *limit) checkRate(now time.Time) *Error {
+	if l.bucket == nil {
+		return nil
+	}
+	if wait := l.bucket.wait(now); wait > 0 {
+		err := NewError(ErrorRateLimited, "Rate limit exceeded")
+		err.Data = map[string]interface{}{
+			"retry_after_ms": wait.Milliseconds() + 1,
+		}
+		return err
+	}
+	return nil
+}
+
+func (l *limit) acquire() {
+	if l.bucket != nil {
+		l.bucket.tokens--
+	}
+	l.inFlight++
+}
+
+func newLimit(cfg config.RateLimit) *limit {
+	return &limit{
+		bucket:      newTokenBucket(cfg.Rate, cfg.Burst),
+		concurrency: cfg.Concurrency,
+	}
+}
+
+type LimitCounters struct {
+	Allowed            uint64 `json:"allowed"`
+	RateLimited        uint64 `json:"rate_limited"`
+	ConcurrencyLimited uint64 `json:"concurrency_limited"`
+	InFlight           int    `json:"in_flight"`
+}
+
+type LimitsStatsRequest struct {
+}
+
+type LimitsStatsResponse struct {
+	Global  LimitCounters            `json:"global"`
+	Methods map[string]LimitCounters `json:"methods"`
+}
+
+// LimitsStats exposes rate limiter counters for monitoring
+var LimitsStats = jsonrpc.Method[LimitsStatsRequest, LimitsStatsResponse]{Name: "kcc.limits.stats"}
+
+// limitExempt are never limited, they must get through a flood of other calls
+var limitExempt = map[string]struct{}{
+	Cancel.Name:      {},
+	LimitsStats.Name: {},
+}
+
+// Limiter enforces token bucket rate limits and concurrency caps on cloud
+// calls, globally and per method pattern. Methods matching the same pattern
+// share its limit.
+type Limiter struct {
+	mutex    sync.Mutex
+	global   *limit
+	methods  map[string]*limit
+	counters map[string]*LimitCounters
+	total    LimitCounters
+}
+
+// count updates counters of method and global ones
+func (l *Limiter) count(method string, update func(counters *LimitCounters)) {
+	counters, ok := l.counters[method]
+	if !ok {
+		counters = &LimitCounters{}
+		l.counters[method] = counters
+	}
+	update(counters)
+	update(&l.total)
+}
+
+// Acquire admits call of method, release must be called once call completes
+func (l *Limiter) Acquire(method string) (func(), *Error) {
+	if _, ok := urgentMethods[method]; ok {
+		return func() {}, nil
+	}
+	if _, ok := limitExempt[method]; ok {
+		return func() {}, nil
+	}
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	limits := []*limit{l.global}
+	if _, methodLimit, ok := bestMatch(l.methods, method); ok {
+		limits = append(limits, methodLimit)
+	}
+
+	for _, limit := range limits {
+		if err := limit.checkConcurrency(); err != nil {
+			l.count(method, func(counters *LimitCounters) { counters.ConcurrencyLimited++ })
+			return nil, err
+		}
+	}
+	now := time.Now()
+	for _, limit := range limits {
+		if err := limit.checkRate(now); err != nil {
+			l.count(method, func(counters *LimitCounters) { counters.RateLimited++ })
+			return nil, err
+		}
+	}
+
+	for _, limit := range limits {
+		limit.acquire()
+	}
+	l.count(method, func(counters *LimitCounters) {
+		counters.Allowed++
+		counters.InFlight++
+	})
+
+	return func() {
+		l.mutex.Lock()
+		defer l.mutex.Unlock()
+		for _, limit := range limits {
+			limit.inFlight--
+		}
+		l.count(method, func(counters *LimitCounters) { counters.InFlight-- })
+	}, nil
+}
+
+func (l *Limiter) Stats() LimitsStatsResponse {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	methods := map[string]LimitCounters{}
+	for method, counters := range l.counters {
+		methods[method] = *counters
+	}
+	return LimitsStatsResponse{
+		Global:  l.total,
+		Methods: methods,
+	}
+}
+
+func NewLimiter(cfg config.LimitsConfig) *Limiter {
+	limiter := &Limiter{
+		global:   newLimit(cfg.Global),
+		methods:  map[string]*limit{},
+		counters: map[string]*LimitCounters{},
+	}
+	for pattern, methodLimit := range cfg.Methods {
+		limiter.methods[pattern] = newLimit(methodLimit)
+	}
+	return limiter
+}
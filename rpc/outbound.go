@@ -0,0 +1,346 @@
+package rpc
+
+import (
+	"encoding/json"
+	"github.com/finomen/go-moonraker-api/api"
+	"klipper-cloud-control-client/config"
+	"log"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	DefaultOutboundQueueSize = 1024
+)
+
+type OutboundPolicy string
+
+const (
+	// PolicyDrop messages are discarded while cloud is offline
+	PolicyDrop OutboundPolicy = "drop"
+	// PolicyKeep messages are kept for replay after reconnect
+	PolicyKeep OutboundPolicy = "keep"
+	// PolicyCoalesce messages are merged into a single latest-state message
+	PolicyCoalesce OutboundPolicy = "coalesce"
+)
+
+var defaultOutboundPolicies = map[string]OutboundPolicy{
+	api.NotifyKlippyReady.Name:        PolicyKeep,
+	api.NotifyKlippyShutdown.Name:     PolicyKeep,
+	api.NotifyKlippyDisconnected.Name: PolicyKeep,
+	api.NotifyHistoryChanged.Name:     PolicyKeep,
+	api.NotifyJobQueueChanged.Name:    PolicyKeep,
+	api.NotifyStatusUpdate.Name:       PolicyCoalesce,
+	api.NotifyProcStatUpdate.Name:     PolicyCoalesce,
+	PrinterConnectionNotify.Name:      PolicyCoalesce,
+}
+
+// merge functions for coalesced methods, methods without one keep the latest message
+var outboundMergers = map[string]func(previous []byte, next []byte) []byte{
+	api.NotifyStatusUpdate.Name: mergeStatusUpdate,
+}
+
+// bulkNotifications are held back while uplink quality is poor and are not
+// sent at all in low-data mode
+var bulkNotifications = map[string]struct{}{
+	api.NotifyStatusUpdate.Name:   {},
+	api.NotifyProcStatUpdate.Name: {},
+}
+
+// outboundMessage is a message sent with its method already known
+type outboundMessage struct {
+	method string
+	data   []byte
+}
+
+type outboundEntry struct {
+	method string
+	policy OutboundPolicy
+	data   []byte
+}
+
+// Outbound is a bounded queue between the cloud jsonrpc client and the cloud
+// socket. It never blocks the producer: while the cloud is offline or slow,
+// messages are kept, coalesced or dropped according to their policy.
+type Outbound struct {
+	input     chan []byte
+	messages  chan outboundMessage
+	output    chan []byte
+	connected chan bool
+	deferred  chan bool
+	done      chan struct{}
+
+	policies  map[string]OutboundPolicy
+	queueSize int
+
+	queue     []*outboundEntry
+	coalesced map[string]*outboundEntry
+	online    bool
+	deferring bool
+	// backlog mirrors queue length for readers outside of run loop
+	backlog int64
+}
+
+func (o *Outbound) policy(method string) OutboundPolicy {
+	if policy, ok := o.policies[method]; ok {
+		return policy
+	}
+	return PolicyDrop
+}
+
+// enqueueRaw queues message written to C, its method is found by header scan
+func (o *Outbound) enqueueRaw(data []byte) {
+	// Batch responses carry no method and are handled like plain responses
+	if isBatch(data) {
+		o.enqueue("", data)
+		return
+	}
+	header, ok := scanHeader(data)
+	if !ok {
+		log.Println("Outbound message is not jsonrpc")
+		return
+	}
+	o.enqueue(string(header.Method), data)
+}
+
+func (o *Outbound) enqueue(method string, data []byte) {
+	entry := &outboundEntry{
+		method: method,
+		policy: o.policy(method),
+		data:   data,
+	}
+
+	if !o.online && entry.policy == PolicyDrop {
+		return
+	}
+
+	if entry.policy == PolicyCoalesce {
+		if pending, ok := o.coalesced[entry.method]; ok {
+			if merge, ok := outboundMergers[entry.method]; ok {
+				entry.data = merge(pending.data, entry.data)
+			}
+			// Merged message carries newest state, so it takes position of the
+			// newest one rather than overtaking messages queued after the old one
+			for i, queued := range o.queue {
+				if queued == pending {
+					o.remove(i)
+					break
+				}
+			}
+		}
+		o.coalesced[entry.method] = entry
+	}
+
+	if len(o.queue) >= o.queueSize {
+		o.evict()
+	}
+	o.queue = append(o.queue, entry)
+}
+
+// evict removes oldest non-kept entry, or oldest entry if everything is kept
+func (o *Outbound) evict() {
+	victim := 0
+	for i, entry := range o.queue {
+		if entry.policy != PolicyKeep {
+			victim = i
+			break
+		}
+	}
+	entry := o.queue[victim]
+	log.Println("Outbound queue full, dropping ", entry.method)
+	o.remove(victim)
+}
+
+func (o *Outbound) remove(i int) {
+	entry := o.queue[i]
+	if o.coalesced[entry.method] == entry {
+		delete(o.coalesced, entry.method)
+	}
+	o.queue = append(o.queue[:i], o.queue[i+1:]...)
+}
+
+// purge drops messages which make no sense after reconnect
+func (o *Outbound) purge() {
+	kept := o.queue[:0]
+	for _, entry := range o.queue {
+		if entry.policy == PolicyDrop {
+			continue
+		}
+		kept = append(kept, entry)
+	}
+	o.queue = kept
+}
+
+// next returns index of entry to be sent, deferrable entries are skipped
+// while deferring. It returns -1 if there is nothing to send.
+func (o *Outbound) next() int {
+	if !o.online {
+		return -1
+	}
+	for i, entry := range o.queue {
+		if _, ok := bulkNotifications[entry.method]; ok && o.deferring {
+			continue
+		}
+		return i
+	}
+	return -1
+}
+
+func (o *Outbound) run() {
+	for {
+		var output chan []byte
+		var head []byte
+		next := o.next()
+		if next >= 0 {
+			output = o.output
+			head = o.queue[next].data
+		}
+
+		select {
+		case data := <-o.input:
+			o.enqueueRaw(data)
+		case message := <-o.messages:
+			o.enqueue(message.method, message.data)
+		case output <- head:
+			o.remove(next)
+		case online := <-o.connected:
+			o.online = online
+			if !online {
+				o.purge()
+			}
+		case deferring := <-o.deferred:
+			o.deferring = deferring
+		case <-o.done:
+			return
+		}
+		atomic.StoreInt64(&o.backlog, int64(len(o.queue)))
+	}
+}
+
+// Backlog returns number of queued messages
+func (o *Outbound) Backlog() int {
+	return int(atomic.LoadInt64(&o.backlog))
+}
+
+func (o *Outbound) Capacity() int {
+	return o.queueSize
+}
+
+// SetDeferred holds back bulk notifications until it is reset, they keep being coalesced
+func (o *Outbound) SetDeferred(deferred bool) {
+	select {
+	case o.deferred <- deferred:
+	case <-o.done:
+	}
+}
+
+// C is the channel jsonrpc client writes to
+func (o *Outbound) C() chan []byte {
+	return o.input
+}
+
+// Send queues message whose method is known to the caller, empty for responses
+func (o *Outbound) Send(method string, data []byte) {
+	select {
+	case o.messages <- outboundMessage{method: method, data: data}:
+	case <-o.done:
+	}
+}
+
+// SetConnected switches between online delivery and offline buffering
+func (o *Outbound) SetConnected(connected bool) {
+	select {
+	case o.connected <- connected:
+	case <-o.done:
+	}
+}
+
+func (o *Outbound) Close() {
+	close(o.done)
+}
+
+func NewOutbound(output chan []byte, cfg config.OutboundConfig) *Outbound {
+	policies := map[string]OutboundPolicy{}
+	for method, policy := range defaultOutboundPolicies {
+		policies[method] = policy
+	}
+	for method, policy := range cfg.Policies {
+		policies[method] = OutboundPolicy(policy)
+	}
+
+	queueSize := cfg.QueueSize
+	if queueSize <= 0 {
+		queueSize = DefaultOutboundQueueSize
+	}
+
+	outbound := &Outbound{
+		input:     make(chan []byte, ChannelSize),
+		messages:  make(chan outboundMessage, ChannelSize),
+		output:    output,
+		connected: make(chan bool),
+		deferred:  make(chan bool),
+		done:      make(chan struct{}),
+		policies:  policies,
+		queueSize: queueSize,
+		coalesced: map[string]*outboundEntry{},
+	}
+
+	go outbound.run()
+
+	return outbound
+}
+
+type statusUpdate struct {
+	Jsonrpc string        `json:"jsonrpc"`
+	Method  string        `json:"method"`
+	Params  []interface{} `json:"params"`
+	Seq     uint64        `json:"seq,omitempty"`
+	Time    *time.Time    `json:"ts,omitempty"`
+}
+
+// mergeStatusUpdate applies next status diff on top of previous one
+func mergeStatusUpdate(previous []byte, next []byte) []byte {
+	prev := statusUpdate{}
+	diff := statusUpdate{}
+	if json.Unmarshal(previous, &prev) != nil || json.Unmarshal(next, &diff) != nil {
+		return next
+	}
+	if len(prev.Params) == 0 || len(diff.Params) == 0 {
+		return next
+	}
+
+	prevStatus, ok := prev.Params[0].(map[string]interface{})
+	if !ok {
+		return next
+	}
+	diffStatus, ok := diff.Params[0].(map[string]interface{})
+	if !ok {
+		return next
+	}
+
+	diff.Params[0] = mergeObjects(prevStatus, diffStatus)
+
+	data, err := json.Marshal(diff)
+	if err != nil {
+		return next
+	}
+	return data
+}
+
+// mergeObjects recursively merges diff into base and returns base
+func mergeObjects(base map[string]interface{}, diff map[string]interface{}) map[string]interface{} {
+	for key, value := range diff {
+		diffValue, ok := value.(map[string]interface{})
+		if !ok {
+			base[key] = value
+			continue
+		}
+		baseValue, ok := base[key].(map[string]interface{})
+		if !ok {
+			base[key] = diffValue
+			continue
+		}
+		base[key] = mergeObjects(baseValue, diffValue)
+	}
+	return base
+}
@@ -0,0 +1,64 @@
+package rpc
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"path"
+)
+
+// matchMethod reports whether method matches any of glob patterns
+func matchMethod(patterns []string, method string) bool {
+	for _, pattern := range patterns {
+		matched, err := path.Match(pattern, method)
+		if err != nil {
+			log.Println("Invalid method pattern ", pattern, ": ", err)
+			continue
+		}
+		if matched {
+			return true
+		}
+	}
+	return false
+}
+
+// bestMatch looks up value by exact method name, then by the longest matching glob pattern
+func bestMatch[T interface{}](patterns map[string]T, method string) (string, T, bool) {
+	if value, ok := patterns[method]; ok {
+		return method, value, true
+	}
+	best := ""
+	var value T
+	found := false
+	for pattern, candidate := range patterns {
+		if matched, _ := path.Match(pattern, method); matched && (!found || len(pattern) > len(best)) {
+			best = pattern
+			value = candidate
+			found = true
+		}
+	}
+	return best, value, found
+}
+
+func (b *Bridge) passthroughAllowed(method string) bool {
+	return matchMethod(b.passthrough, method)
+}
+
+// forward returns handler passing raw request to Moonraker and raw result or error back
+func (b *Bridge) forward(method string) Handler {
+	return func(ctx context.Context, params json.RawMessage) (json.RawMessage, *Error) {
+		var request interface{}
+		if len(params) != 0 && string(params) != "null" {
+			request = params
+		}
+		if err := b.awaitKlippy(ctx, method, params); err != nil {
+			return nil, err
+		}
+		result, err := b.printer.Call(ctx, method, request)
+		if err != nil {
+			return nil, err
+		}
+		b.observe(method, result)
+		return result, nil
+	}
+}
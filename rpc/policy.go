@@ -0,0 +1,149 @@
+package rpc
+
+import (
+	"klipper-cloud-control-client/config"
+	"log"
+	"path"
+	"strings"
+)
+
+const (
+	PresetReadOnly  = "read_only"
+	PresetNoMachine = "no_machine"
+)
+
+type policyPreset struct {
+	allow []string
+	deny  []string
+}
+
+var policyPresets = map[string]policyPreset{
+	// read_only lets cloud observe the printer without changing anything
+	PresetReadOnly: {
+		allow: []string{
+			"server.connection.identify",
+			"server.websocket.id",
+			"server.info",
+			"server.config",
+			"server.temperature_store",
+			"server.gcode_store",
+			"server.files.list",
+			"server.files.metadata",
+			"server.files.get_directory",
+			"server.database.list",
+			"server.database.get_item",
+			"server.job_queue.status",
+			"server.announcements.list",
+			"server.announcements.feeds",
+			"server.history.list",
+			"server.history.totals",
+			"server.history.get_job",
+			"printer.info",
+			"printer.objects.*",
+			"printer.query_endstops.status",
+			"printer.gcode.help",
+			"machine.system_info",
+			"machine.proc_stats",
+			"machine.update.status",
+			"cloud.upload",
+			JournalSince.Name,
+			Cancel.Name,
+			LimitsStats.Name,
+			UsageStatsMethod.Name,
+			LinkStats.Name,
+			AuditRecent.Name,
+		},
+	},
+	// no_machine forbids host power management, service control and updates
+	PresetNoMachine: {
+		deny: []string{
+			"machine.shutdown",
+			"machine.reboot",
+			"machine.services.*",
+			"machine.device_power.*",
+			"machine.update.full",
+			"machine.update.moonraker",
+			"machine.update.klipper",
+			"machine.update.client",
+			"machine.update.system",
+			"machine.update.recover",
+			"machine.update.refresh",
+		},
+	},
+}
+
+// Policy decides which methods the cloud may call. Deny patterns always win,
+// non-empty allow list restricts calls to matching methods only.
+type Policy struct {
+	allow []string
+	deny  []string
+
+	files    []config.ArgumentRule
+	database []config.ArgumentRule
+}
+
+// matchPath reports whether any pattern matches target or one of its parents
+func matchPath(patterns []string, target string) bool {
+	for current := target; current != "." && current != "/" && current != ""; current = path.Dir(current) {
+		if matchMethod(patterns, current) {
+			return true
+		}
+	}
+	return false
+}
+
+func checkArguments(rules []config.ArgumentRule, method string, kind string, target string) *Error {
+	for _, rule := range rules {
+		if len(rule.Methods) > 0 && !matchMethod(rule.Methods, method) {
+			continue
+		}
+		if matchPath(rule.Deny, target) || (len(rule.Allow) > 0 && !matchPath(rule.Allow, target)) {
+			err := NewError(ErrorForbidden, "%s %s is not allowed for %s by device policy", kind, target, method)
+			err.Data = map[string]string{kind: target}
+			return err
+		}
+	}
+	return nil
+}
+
+// CheckFiles returns error if any of file paths is not allowed for method
+func (p *Policy) CheckFiles(method string, paths ...string) *Error {
+	for _, filePath := range paths {
+		target := strings.TrimPrefix(path.Clean("/"+filePath), "/")
+		if err := checkArguments(p.files, method, "path", target); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// CheckDatabase returns error if namespace and key are not allowed for method
+func (p *Policy) CheckDatabase(method string, namespace string, key string) *Error {
+	return checkArguments(p.database, method, "item", namespace+"/"+key)
+}
+
+// Check returns error if method is not allowed
+func (p *Policy) Check(method string) *Error {
+	if matchMethod(p.deny, method) || (len(p.allow) > 0 && !matchMethod(p.allow, method)) {
+		return NewError(ErrorForbidden, "Method %s is not allowed by device policy", method)
+	}
+	return nil
+}
+
+func NewPolicy(cfg config.PolicyConfig) *Policy {
+	policy := &Policy{}
+	for _, name := range cfg.Presets {
+		preset, ok := policyPresets[name]
+		if !ok {
+			log.Println("Unknown policy preset ", name)
+			continue
+		}
+		policy.allow = append(policy.allow, preset.allow...)
+		policy.deny = append(policy.deny, preset.deny...)
+	}
+	policy.allow = append(policy.allow, cfg.Allow...)
+	policy.deny = append(policy.deny, cfg.Deny...)
+	policy.files = cfg.Files
+	policy.database = cfg.Database
+	return policy
+}
@@ -0,0 +1,303 @@
+package rpc
+
+import (
+	"github.com/finomen/go-moonraker-api/jsonrpc"
+	"log"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	QualityGood     = "good"
+	QualityDegraded = "degraded"
+	QualityPoor     = "poor"
+)
+
+const (
+	qualityInterval = PingPeriod
+	// qualityRecovery is number of consecutive better evaluations needed to restore quality
+	qualityRecovery = 3
+	degradedRtt     = 500 * time.Millisecond
+	poorRtt         = 2 * time.Second
+	// backlog thresholds are fractions of outbound queue size
+	degradedBacklog = 0.25
+	poorBacklog     = 0.75
+	rttSmoothing    = 0.3
+)
+
+// qualityWindows are minimal status update merge windows for each quality level
+var qualityWindows = map[string]time.Duration{
+	QualityGood:     0,
+	QualityDegraded: time.Second,
+	QualityPoor:     5 * time.Second,
+}
+
+var qualityRank = map[string]int{
+	QualityGood:     0,
+	QualityDegraded: 1,
+	QualityPoor:     2,
+}
+
+type LinkQuality struct {
+	Quality       string  `json:"quality"`
+	RttMs         float64 `json:"rtt_ms"`
+	ThroughputBps float64 `json:"throughput_bps"`
+	Backlog       int     `json:"backlog"`
+	// CompressionRatio is size of sent messages to size of websocket frames
+	// carrying them since connect. Frames of TLS connection through a proxy
+	// can not be measured, network bytes including TLS overhead are used
+	// then and the ratio understates deflate gains.
+	CompressionRatio float64 `json:"compression_ratio"`
+}
+
+// LinkQualityNotify reports uplink quality level to the cloud when it changes
+var LinkQualityNotify = jsonrpc.Notify[[]LinkQuality]{Name: "kcc.link.quality"}
+
+type LinkStatsRequest struct {
+}
+
+// LinkStats lets cloud query uplink quality and compression ratio at any time
+var LinkStats = jsonrpc.Method[LinkStatsRequest, LinkQuality]{Name: "kcc.link.stats"}
+
+// LinkMonitor measures round trip time from ping/pong and outbound
+// throughput of a socket, and grades the link using outbound backlog.
+type LinkMonitor struct {
+	mutex       sync.Mutex
+	rtt         time.Duration
+	pingSent    time.Time
+	awaiting    bool
+	written     int64
+	wire        int64
+	payloadSent int64
+	wireSent    int64
+	measured    time.Time
+	throughput  float64
+	quality     string
+	improvement int
+	last        LinkQuality
+
+	// framedPayload is part of payloadSent with known frame sizes, framedSent
+	// is their sum
+	framedPayload int64
+	framedSent    int64
+}
+
+// PingPayload stamps ping sent now, payload is echoed back in pong
+func (m *LinkMonitor) PingPayload(now time.Time) []byte {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.pingSent = now
+	m.awaiting = true
+	return []byte(strconv.FormatInt(now.UnixNano(), 10))
+}
+
+// Pong measures round trip of the outstanding ping, pongs to pings sent
+// before Reset are ignored
+func (m *LinkMonitor) Pong(payload string, now time.Time) {
+	sent, err := strconv.ParseInt(payload, 10, 64)
+	if err != nil {
+		return
+	}
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if !m.awaiting || sent != m.pingSent.UnixNano() {
+		return
+	}
+	m.awaiting = false
+	rtt := now.Sub(m.pingSent)
+	if m.rtt == 0 {
+		m.rtt = rtt
+	} else {
+		m.rtt = time.Duration(rttSmoothing*float64(rtt) + (1-rttSmoothing)*float64(m.rtt))
+	}
+}
+
+// Written accounts sent message, frame is its size after compression or zero
+// when it is not measured
+func (m *LinkMonitor) Written(bytes int, frame int) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.written += int64(bytes)
+	m.payloadSent += int64(bytes)
+	if frame > 0 {
+		m.framedPayload += int64(bytes)
+		m.framedSent += int64(frame)
+	}
+}
+
+// Wire accounts bytes sent over network, they differ from payload when compressed
+func (m *LinkMonitor) Wire(sent int) {
+	if sent == 0 {
+		return
+	}
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.wire += int64(sent)
+	m.wireSent += int64(sent)
+}
+
+// Reset forgets measurements and quality of previous connection, including
+// ping still waiting for pong
+func (m *LinkMonitor) Reset() {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.rtt = 0
+	m.pingSent = time.Time{}
+	m.awaiting = false
+	m.quality = QualityGood
+	m.improvement = 0
+	m.last = initialQuality()
+	m.written = 0
+	m.wire = 0
+	m.payloadSent = 0
+	m.wireSent = 0
+	m.framedPayload = 0
+	m.framedSent = 0
+	m.measured = time.Now()
+	m.throughput = 0
+}
+
+func grade(rtt time.Duration, backlog float64) string {
+	switch {
+	case rtt >= poorRtt || backlog >= poorBacklog:
+		return QualityPoor
+	case rtt >= degradedRtt || backlog >= degradedBacklog:
+		return QualityDegraded
+	default:
+		return QualityGood
+	}
+}
+
+// Evaluate grades link, backlog is outbound queue fill ratio. Quality drops
+// immediately and is restored only after it stays better for a while.
+func (m *LinkMonitor) Evaluate(backlog int, capacity int, now time.Time) (LinkQuality, bool) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	// Network bytes are preferred as they reflect compression and framing
+	sent := m.written
+	if m.wire > 0 {
+		sent = m.wire
+	}
+	if elapsed := now.Sub(m.measured).Seconds(); elapsed > 0 {
+		m.throughput = float64(sent) / elapsed
+	}
+	m.written = 0
+	m.wire = 0
+	m.measured = now
+
+	// Unanswered ping means round trip is at least as long as it is outstanding
+	rtt := m.rtt
+	if m.awaiting && now.Sub(m.pingSent) > rtt {
+		rtt = now.Sub(m.pingSent)
+	}
+
+	fill := 0.0
+	if capacity > 0 {
+		fill = float64(backlog) / float64(capacity)
+	}
+
+	changed := false
+	measured := grade(rtt, fill)
+	switch {
+	case qualityRank[measured] > qualityRank[m.quality]:
+		m.quality = measured
+		m.improvement = 0
+		changed = true
+	case qualityRank[measured] < qualityRank[m.quality]:
+		m.improvement++
+		if m.improvement >= qualityRecovery {
+			m.quality = measured
+			m.improvement = 0
+			changed = true
+		}
+	default:
+		m.improvement = 0
+	}
+
+	m.last = LinkQuality{
+		Quality:          m.quality,
+		RttMs:            float64(rtt.Microseconds()) / 1000,
+		ThroughputBps:    m.throughput,
+		Backlog:          backlog,
+		CompressionRatio: m.ratio(),
+	}
+	return m.last, changed
+}
+
+// ratio is compression ratio, must be called under lock
+func (m *LinkMonitor) ratio() float64 {
+	switch {
+	case m.framedSent > 0:
+		return float64(m.framedPayload) / float64(m.framedSent)
+	case m.wireSent > 0:
+		return float64(m.payloadSent) / float64(m.wireSent)
+	default:
+		return 1
+	}
+}
+
+// Stats returns result of the latest evaluation with current backlog and
+// compression ratio
+func (m *LinkMonitor) Stats(backlog int) LinkQuality {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	stats := m.last
+	stats.Backlog = backlog
+	stats.CompressionRatio = m.ratio()
+	return stats
+}
+
+// Last returns result of the latest evaluation
+func (m *LinkMonitor) Last() LinkQuality {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	return m.last
+}
+
+// initialQuality is assumed until link is measured
+func initialQuality() LinkQuality {
+	return LinkQuality{
+		Quality:          QualityGood,
+		CompressionRatio: 1,
+	}
+}
+
+func NewLinkMonitor() *LinkMonitor {
+	return &LinkMonitor{
+		quality:  QualityGood,
+		measured: time.Now(),
+		last:     initialQuality(),
+	}
+}
+
+// monitorLink adapts uplink traffic to measured link quality
+func (b *Bridge) monitorLink() {
+	ticker := time.NewTicker(qualityInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case now := <-ticker.C:
+			quality, changed := b.link.Evaluate(b.cloudOutbound.Backlog(), b.cloudOutbound.Capacity(), now)
+			if changed {
+				b.applyQuality(quality)
+			}
+		case <-b.done:
+			return
+		}
+	}
+}
+
+func (b *Bridge) applyQuality(quality LinkQuality) {
+	log.Println("Uplink quality ", quality.Quality, ", rtt ", quality.RttMs, "ms")
+	b.throttle.SetAdaptiveWindow(qualityWindows[quality.Quality])
+	b.cloudOutbound.SetDeferred(quality.Quality == QualityPoor)
+	b.reportQuality(quality)
+}
+
+func (b *Bridge) reportQuality(quality LinkQuality) {
+	LinkQualityNotify.Send([]LinkQuality{quality}, b.cloudConnection)
+}
@@ -0,0 +1,57 @@
+package rpc
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLinkMonitorResetDropsPing(t *testing.T) {
+	monitor := NewLinkMonitor()
+	start := time.Now()
+
+	payload := monitor.PingPayload(start)
+	quality, _ := monitor.Evaluate(0, 100, start.Add(3*time.Second))
+	if quality.Quality != QualityPoor {
+		t.Fatalf("outstanding ping graded %s, want %s", quality.Quality, QualityPoor)
+	}
+
+	monitor.Reset()
+	if last := monitor.Last(); last.Quality != QualityGood {
+		t.Errorf("quality after reset is %s", last.Quality)
+	}
+	monitor.Pong(string(payload), start.Add(4*time.Second))
+	quality, _ = monitor.Evaluate(0, 100, start.Add(5*time.Second))
+	if quality.Quality != QualityGood || quality.RttMs != 0 {
+		t.Errorf("stale ping counted after reset: %+v", quality)
+	}
+
+	now := start.Add(6 * time.Second)
+	payload = monitor.PingPayload(now)
+	monitor.Pong(string(payload), now.Add(100*time.Millisecond))
+	quality, _ = monitor.Evaluate(0, 100, now.Add(time.Second))
+	if quality.RttMs != 100 {
+		t.Errorf("rtt is %vms, want 100ms", quality.RttMs)
+	}
+}
+
+func TestLinkMonitorCompressionRatio(t *testing.T) {
+	monitor := NewLinkMonitor()
+	monitor.Wire(2000)
+	monitor.Written(1000, 0)
+	if ratio := monitor.Stats(0).CompressionRatio; ratio != 0.5 {
+		t.Errorf("ratio from network bytes is %v, want 0.5", ratio)
+	}
+
+	// Frame sizes are preferred, messages without them are left out
+	monitor.Written(1000, 250)
+	monitor.Written(1000, 250)
+	stats := monitor.Stats(7)
+	if stats.CompressionRatio != 4 || stats.Backlog != 7 {
+		t.Errorf("stats are %+v, want ratio 4 and backlog 7", stats)
+	}
+
+	monitor.Reset()
+	if ratio := monitor.Stats(0).CompressionRatio; ratio != 1 {
+		t.Errorf("ratio after reset is %v", ratio)
+	}
+}
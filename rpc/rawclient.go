@@ -0,0 +1,281 @@
+package rpc
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/finomen/go-moonraker-api/api"
+	"log"
+	"sync"
+)
+
+type rawRequest struct {
+	Jsonrpc string      `json:"jsonrpc"`
+	Method  string      `json:"method"`
+	Params  interface{} `json:"params,omitempty"`
+	Id      uint64      `json:"id"`
+}
+
+type rawResponse struct {
+	Id     *uint64         `json:"id"`
+	Result json.RawMessage `json:"result"`
+	Error  *Error          `json:"error"`
+}
+
+// urgentMethods are sent through priority lane ahead of bulk traffic
+var urgentMethods = map[string]struct{}{
+	api.PrinterEmergencyStop.Name:   {},
+	api.PrinterPrintPause.Name:      {},
+	api.PrinterPrintCancel.Name:     {},
+	api.PrinterFirmwareRestart.Name: {},
+}
+
+// NotifyHandler receives notification params and the original message
+// without decoding, it returns false if notification is not handled
+type NotifyHandler func(method string, params json.RawMessage, data []byte) bool
+
+// RawClient performs JSON-RPC calls keeping raw result and error objects,
+// which jsonrpc.Client drops. Incoming messages are parsed only once:
+// responses are routed to pending calls and notifications are passed to
+// notify handler as raw bytes.
+type RawClient struct {
+	tx       chan []byte
+	priority chan []byte
+	done     chan struct{}
+	notify   NotifyHandler
+
+	mutex     sync.Mutex
+	pending   map[uint64]chan rawResponse
+	nextId    uint64
+	connected bool
+	// offline is closed when connection is lost, it aborts calls waiting to be sent
+	offline chan struct{}
+}
+
+func (c *RawClient) run(rx chan []byte) {
+	for {
+		select {
+		case data := <-rx:
+			c.route(data)
+		case <-c.done:
+			return
+		}
+	}
+}
+
+// route delivers response to pending call or notification to notify handler.
+// Notifications are only scanned for method and params, responses are decoded.
+func (c *RawClient) route(data []byte) {
+	header, ok := scanHeader(data)
+	if !ok {
+		//TODO: make this log debug
+		log.Println("Failed to parse jsonrpc message")
+		return
+	}
+
+	if len(header.Method) > 0 {
+		method := string(header.Method)
+		if header.notification() && c.notify(method, header.Params, data) {
+			return
+		}
+		log.Println("Call unsupported method ", method)
+		return
+	}
+
+	message := rawResponse{}
+	if err := json.Unmarshal(data, &message); err != nil {
+		//TODO: make this log debug
+		log.Println("Failed to parse jsonrpc message: ", err)
+		return
+	}
+	if message.Id == nil {
+		log.Println("Response without id")
+		return
+	}
+
+	c.mutex.Lock()
+	waiter, ok := c.pending[*message.Id]
+	delete(c.pending, *message.Id)
+	c.mutex.Unlock()
+
+	if !ok {
+		//TODO: make this log debug
+		log.Println("Response to non-existent request")
+		return
+	}
+	waiter <- message
+}
+
+// Call sends request and waits for result or error until ctx is done, it
+// fails immediately while printer is offline
+func (c *RawClient) Call(ctx context.Context, method string, params interface{}) (json.RawMessage, *Error) {
+	c.mutex.Lock()
+	if !c.connected {
+		c.mutex.Unlock()
+		return nil, printerOffline()
+	}
+	offline := c.offline
+	c.nextId++
+	id := c.nextId
+	waiter := make(chan rawResponse, 1)
+	c.pending[id] = waiter
+	c.mutex.Unlock()
+
+	defer func() {
+		c.mutex.Lock()
+		delete(c.pending, id)
+		c.mutex.Unlock()
+	}()
+
+	data, err := json.Marshal(rawRequest{
+		Jsonrpc: "2.0",
+		Method:  method,
+		Params:  params,
+		Id:      id,
+	})
+	if err != nil {
+		return nil, NewError(ErrorInvalidParams, "Failed to serialize request: %v", err)
+	}
+
+	tx := c.tx
+	if _, ok := urgentMethods[method]; ok {
+		tx = c.priority
+	}
+	if err := c.send(ctx, tx, data, offline); err != nil {
+		return nil, err
+	}
+
+	select {
+	case response, ok := <-waiter:
+		if !ok {
+			return nil, NewError(ErrorPrinterDisconnected, "Printer disconnected")
+		}
+		if response.Error != nil {
+			return nil, response.Error
+		}
+		if len(response.Result) == 0 {
+			return json.RawMessage("null"), nil
+		}
+		return response.Result, nil
+	case <-ctx.Done():
+		return nil, contextError(ctx)
+	}
+}
+
+// send queues request unless connection it was issued for is lost. Queueing
+// is attempted under lock first, so it can't interleave with Disconnected
+// dropping queued requests.
+func (c *RawClient) send(ctx context.Context, tx chan []byte, data []byte, offline chan struct{}) *Error {
+	c.mutex.Lock()
+	select {
+	case <-offline:
+		c.mutex.Unlock()
+		return printerOffline()
+	default:
+	}
+	select {
+	case tx <- data:
+		c.mutex.Unlock()
+		return nil
+	default:
+	}
+	c.mutex.Unlock()
+
+	select {
+	case tx <- data:
+	case <-offline:
+		return printerOffline()
+	case <-ctx.Done():
+		return contextError(ctx)
+	}
+
+	// Queue had room only after connection was lost, request must not reach
+	// the next connection
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	select {
+	case <-offline:
+		if !c.connected {
+			c.drop()
+		}
+		return printerOffline()
+	default:
+	}
+	return nil
+}
+
+// Connected allows calls to be sent to the new connection, requests queued
+// for the previous one are dropped first
+func (c *RawClient) Connected() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.drop()
+	c.connected = true
+	c.offline = make(chan struct{})
+}
+
+// Disconnected fails all pending calls, responses will never arrive. Requests
+// still queued for sending are dropped, so they are not executed by the next
+// connection out of context.
+func (c *RawClient) Disconnected() {
+	c.mutex.Lock()
+	if c.connected {
+		c.connected = false
+		close(c.offline)
+	}
+	for id, waiter := range c.pending {
+		close(waiter)
+		delete(c.pending, id)
+	}
+	c.drop()
+	c.mutex.Unlock()
+}
+
+// drop discards requests queued for sending, must be called under lock
+func (c *RawClient) drop() {
+	dropped := 0
+	for {
+		select {
+		case <-c.priority:
+			dropped++
+		case <-c.tx:
+			dropped++
+		default:
+			if dropped > 0 {
+				log.Println("Dropped ", dropped, " stale printer requests")
+			}
+			return
+		}
+	}
+}
+
+func (c *RawClient) Close() {
+	close(c.done)
+}
+
+// NewRawClient starts client reading rx, urgent requests are sent to priority
+// instead of tx
+func NewRawClient(rx chan []byte, tx chan []byte, priority chan []byte, notify NotifyHandler) *RawClient {
+	client := &RawClient{
+		tx:       tx,
+		priority: priority,
+		done:     make(chan struct{}),
+		notify:   notify,
+		pending:  map[uint64]chan rawResponse{},
+	}
+
+	go client.run(rx)
+
+	return client
+}
+
+func printerOffline() *Error {
+	return NewError(ErrorPrinterDisconnected, "Printer is offline")
+}
+
+func contextError(ctx context.Context) *Error {
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return NewError(ErrorTimeout, "Request timed out")
+	}
+	return NewError(ErrorCancelled, "Request cancelled")
+}
@@ -0,0 +1,90 @@
+package rpc
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/finomen/go-moonraker-api/api"
+	"log"
+	"strconv"
+	"time"
+)
+
+type rawNotification struct {
+	Jsonrpc string          `json:"jsonrpc"`
+	Method  string          `json:"method"`
+	Params  json.RawMessage `json:"params"`
+}
+
+// relay forwards printer notification to cloud as raw bytes, params are
+// decoded only where state mirror needs them
+func (b *Bridge) relay(method string, params json.RawMessage, data []byte) bool {
+	if _, ok := b.relayed[method]; !ok {
+		return false
+	}
+
+	b.state.ObserveNotify(method, params)
+	if method == api.NotifyKlippyReady.Name {
+		b.gcode.Invalidate()
+		b.spawn(b.resubscribe)
+	}
+	if method == api.NotifyStatusUpdate.Name && b.throttle.Enabled() {
+		b.throttle.Add(params)
+		return true
+	}
+
+	b.publish(method, params, data)
+	return true
+}
+
+// publish journals notification and sends it to cloud. High-rate status
+// notifications are superseded by the next one and by state snapshot, so they
+// are only timestamped and kept out of the journal.
+func (b *Bridge) publish(method string, params json.RawMessage, data []byte) {
+	if b.ctx.Err() != nil {
+		return
+	}
+	if _, ok := bulkNotifications[method]; ok {
+		if b.usage.LowData() {
+			return
+		}
+		b.cloudOutbound.Send(method, stamp(data, 0, time.Now()))
+		return
+	}
+
+	entry := b.journal.Append(method, params)
+	b.cloudOutbound.Send(method, stamp(data, entry.Seq, entry.Time))
+}
+
+// publishStatus sends status update built by throttle
+func (b *Bridge) publishStatus(params json.RawMessage) {
+	data, err := json.Marshal(rawNotification{
+		Jsonrpc: "2.0",
+		Method:  api.NotifyStatusUpdate.Name,
+		Params:  params,
+	})
+	if err != nil {
+		log.Println("Failed to serialize status update: ", err)
+		return
+	}
+	b.publish(api.NotifyStatusUpdate.Name, params, data)
+}
+
+// stamp appends journal sequence number and timestamp members to jsonrpc
+// notification without re-encoding it, zero seq is omitted
+func stamp(data []byte, seq uint64, ts time.Time) []byte {
+	end := bytes.LastIndexByte(data, '}')
+	if end < 0 {
+		return data
+	}
+
+	stamped := make([]byte, 0, end+64)
+	stamped = append(stamped, data[:end]...)
+	if seq != 0 {
+		stamped = append(stamped, `,"seq":`...)
+		stamped = strconv.AppendUint(stamped, seq, 10)
+	}
+	stamped = append(stamped, `,"ts":"`...)
+	stamped = ts.AppendFormat(stamped, time.RFC3339Nano)
+	stamped = append(stamped, `"}`...)
+	return stamped
+}
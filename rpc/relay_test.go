@@ -0,0 +1,129 @@
+package rpc
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/finomen/go-moonraker-api/api"
+	"github.com/finomen/go-moonraker-api/jsonrpc"
+	"klipper-cloud-control-client/config"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// recordedStatusUpdate is a notify_status_update as moonraker sends it while printing
+var recordedStatusUpdate = []byte(`{"jsonrpc":"2.0","method":"notify_status_update","params":[{` +
+	`"toolhead":{"position":[118.412,96.205,3.4,2104.55],"print_time":1893.2214,"estimated_print_time":1893.5871},` +
+	`"gcode_move":{"gcode_position":[118.412,96.205,3.4,1032.117],"speed":6000.0},` +
+	`"motion_report":{"live_position":[118.3,96.1,3.4,2104.51],"live_velocity":98.43,"live_extruder_velocity":3.12},` +
+	`"extruder":{"temperature":214.97,"power":0.5312},` +
+	`"heater_bed":{"temperature":60.02,"power":0.2183},` +
+	`"temperature_sensor mcu_temp":{"temperature":41.3},` +
+	`"print_stats":{"print_duration":1712.91,"total_duration":1790.44,"filament_used":1032.117},` +
+	`"virtual_sdcard":{"progress":0.3412,"file_position":812733},` +
+	`"display_status":{"progress":0.34}` +
+	`},1893.0452]}`)
+
+// stampedNotification is how notifications were re-encoded before raw relay
+type stampedNotification struct {
+	Jsonrpc string          `json:"jsonrpc"`
+	Method  string          `json:"method"`
+	Params  json.RawMessage `json:"params"`
+	Seq     uint64          `json:"seq"`
+	Time    time.Time       `json:"ts"`
+}
+
+// newRelayBridge builds bridge with just the parts notification relay uses,
+// status updates are kept by outbound so every message reaches output
+func newRelayBridge(b *testing.B, output chan []byte) *Bridge {
+	dir := b.TempDir()
+	outbound := NewOutbound(output, config.OutboundConfig{
+		Policies: map[string]string{api.NotifyStatusUpdate.Name: string(PolicyKeep)},
+	})
+	outbound.SetConnected(true)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	bridge := &Bridge{
+		relayed:       map[string]struct{}{},
+		usage:         NewUsage(config.UsageConfig{Path: filepath.Join(dir, "usage.json")}),
+		cloudOutbound: outbound,
+		journal:       NewJournal(config.JournalConfig{Path: filepath.Join(dir, "journal.jsonl")}),
+		state:         NewPrinterState(),
+		ctx:           ctx,
+		cancel:        cancel,
+		done:          make(chan struct{}),
+	}
+	bridge.throttle = NewStatusThrottle(config.StatusConfig{}, bridge.publishStatus)
+	printerToCloud(api.NotifyStatusUpdate, bridge)
+
+	b.Cleanup(func() {
+		cancel()
+		outbound.Close()
+		bridge.journal.Close()
+		bridge.usage.Close()
+	})
+	return bridge
+}
+
+// benchmarkRelay feeds recorded status update to rx and waits until every
+// copy is written to cloud output
+func benchmarkRelay(b *testing.B, rx chan []byte, output chan []byte) {
+	b.ReportAllocs()
+	b.SetBytes(int64(len(recordedStatusUpdate)))
+	b.ResetTimer()
+
+	go func() {
+		for i := 0; i < b.N; i++ {
+			rx <- recordedStatusUpdate
+		}
+	}()
+	for i := 0; i < b.N; i++ {
+		<-output
+	}
+}
+
+func BenchmarkRelayRaw(b *testing.B) {
+	output := make(chan []byte, ChannelSize)
+	bridge := newRelayBridge(b, output)
+
+	rx := make(chan []byte, ChannelSize)
+	printer := NewRawClient(rx, make(chan []byte, ChannelSize), nil, bridge.relay)
+	defer printer.Close()
+
+	benchmarkRelay(b, rx, output)
+}
+
+// BenchmarkRelayTyped is the jsonrpc.Notify Listen/Send path used before raw
+// relay: params are decoded into typed request, encoded again and wrapped
+// into stamped notification
+func BenchmarkRelayTyped(b *testing.B) {
+	output := make(chan []byte, ChannelSize)
+	bridge := newRelayBridge(b, output)
+
+	rx := make(chan []byte, ChannelSize)
+	printer := jsonrpc.NewClient(rx, make(chan []byte, ChannelSize))
+	defer printer.Close()
+
+	method := api.NotifyStatusUpdate
+	method.Listen(func(request *api.NotifyStatusUpdateRequest) {
+		params, err := json.Marshal(request)
+		if err != nil {
+			b.Error(err)
+			return
+		}
+		bridge.state.ObserveNotify(method.Name, params)
+		data, err := json.Marshal(stampedNotification{
+			Jsonrpc: "2.0",
+			Method:  method.Name,
+			Params:  params,
+			Time:    time.Now(),
+		})
+		if err != nil {
+			b.Error(err)
+			return
+		}
+		bridge.cloudOutbound.C() <- data
+	}, printer)
+
+	benchmarkRelay(b, rx, output)
+}
@@ -0,0 +1,112 @@
+package rpc
+
+import (
+	"context"
+	"klipper-cloud-control-client/config"
+	"log"
+)
+
+const (
+	RoleViewer   = "viewer"
+	RoleOperator = "operator"
+	RoleAdmin    = "admin"
+)
+
+// operatorMethods are allowed to operators in addition to viewer methods
+var operatorMethods = []string{
+	"printer.print.*",
+	"printer.gcode.script",
+	"printer.emergency_stop",
+	"printer.restart",
+	"printer.firmware_restart",
+	"server.files.*",
+	"server.database.*",
+	"server.job_queue.*",
+	"server.history.*",
+	"server.announcements.*",
+}
+
+// adminMethods are read-only methods which are still reserved to admins
+var adminMethods = []string{
+	AuditRecent.Name,
+}
+
+// viewerMethods is the read_only preset without admin methods
+var viewerMethods = withoutMethods(policyPresets[PresetReadOnly].allow, adminMethods)
+
+var defaultRoles = map[string][]string{
+	RoleViewer:   viewerMethods,
+	RoleOperator: append(append([]string{}, viewerMethods...), operatorMethods...),
+	RoleAdmin:    {"*"},
+}
+
+func withoutMethods(methods []string, excluded []string) []string {
+	var result []string
+	for _, method := range methods {
+		if !matchMethod(excluded, method) {
+			result = append(result, method)
+		}
+	}
+	return result
+}
+
+// CloudUser is the acting user asserted by the cloud in "user" member of a request
+type CloudUser struct {
+	Id   string `json:"id"`
+	Name string `json:"name"`
+	Role string `json:"role"`
+}
+
+type userKey struct{}
+
+func withUser(ctx context.Context, user *CloudUser) context.Context {
+	return context.WithValue(ctx, userKey{}, user)
+}
+
+// userFromContext returns acting user of cloud request, nil if unknown
+func userFromContext(ctx context.Context) *CloudUser {
+	user, _ := ctx.Value(userKey{}).(*CloudUser)
+	return user
+}
+
+// Roles maps user roles to methods they may call
+type Roles struct {
+	roles       map[string][]string
+	defaultRole string
+}
+
+// Check returns error if user role does not permit method
+func (r *Roles) Check(user *CloudUser, method string) *Error {
+	role := r.defaultRole
+	if user != nil && user.Role != "" {
+		role = user.Role
+	}
+	methods, ok := r.roles[role]
+	if !ok {
+		return NewError(ErrorForbidden, "Unknown role %s", role)
+	}
+	if !matchMethod(methods, method) {
+		return NewError(ErrorForbidden, "Role %s may not call %s", role, method)
+	}
+	return nil
+}
+
+func NewRoles(cfg config.RolesConfig) *Roles {
+	roles := &Roles{
+		roles:       map[string][]string{},
+		defaultRole: cfg.DefaultRole,
+	}
+	for role, methods := range defaultRoles {
+		roles.roles[role] = methods
+	}
+	for role, methods := range cfg.Roles {
+		roles.roles[role] = methods
+	}
+	if roles.defaultRole == "" {
+		roles.defaultRole = RoleViewer
+	}
+	if _, ok := roles.roles[roles.defaultRole]; !ok {
+		log.Println("Unknown default role ", roles.defaultRole)
+	}
+	return roles
+}
@@ -1,12 +1,18 @@
 package rpc
 
 import (
+	"context"
+	"crypto/tls"
 	"github.com/gorilla/websocket"
+	"klipper-cloud-control-client/config"
 	"log"
+	"net"
 	"net/http"
 	"net/http/cookiejar"
 	"net/url"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -17,89 +23,287 @@ const (
 	PingPeriod     = 5 * time.Second
 	WriteWait      = 10 * time.Second
 	PongWait       = 60 * time.Second
+	// DefaultCompressionMinSize keeps small messages uncompressed, deflate gains nothing on them
+	DefaultCompressionMinSize = 256
 )
 
+// SocketObserver watches socket traffic, it is called from socket pumps
+type SocketObserver interface {
+	// Ping returns payload for ping sent at now, peer echoes it in pong
+	Ping(now time.Time) []byte
+	Pong(payload string, now time.Time)
+	// Sent and Received get JSON message and size of its frame payload. Sent
+	// also gets size of the frame as written after compression, zero when it
+	// is not measured.
+	Sent(message []byte, size int, frame int)
+	Received(message []byte, size int)
+	// Wire reports bytes actually transferred over network connection
+	Wire(sent int, received int)
+}
+
+// SocketOptions tune socket, zero value gives plain uncompressed socket
+type SocketOptions struct {
+	// Priority lane preempts messages queued in tx
+	Priority chan []byte
+	// Observer watches socket traffic
+	Observer SocketObserver
+	// Compression negotiates permessage-deflate with the peer
+	Compression config.CompressionConfig
+	// Codecs are offered to the peer in order of preference, JSON is used if none is accepted
+	Codecs []string
+}
+
+// countingConn reports network traffic to observer
+type countingConn struct {
+	net.Conn
+	observer SocketObserver
+}
+
+func (c countingConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	c.observer.Wire(0, n)
+	return n, err
+}
+
+func (c countingConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	c.observer.Wire(n, 0)
+	return n, err
+}
+
+// framingConn counts bytes websocket writes to connection, they are frames
+// after compression, so it is placed above TLS
+type framingConn struct {
+	net.Conn
+	written *int64
+}
+
+func (c framingConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	atomic.AddInt64(c.written, int64(n))
+	return n, err
+}
+
 type Socket struct {
 	conn      *websocket.Conn
 	ticker    *time.Ticker
 	waitGroup *sync.WaitGroup
+	closeOnce sync.Once
+	ctx       context.Context
 
 	rx chan []byte
 	tx chan []byte
+	// priority lane preempts messages queued in tx, it may be nil
+	priority chan []byte
+	// observer watches traffic, it may be nil
+	observer SocketObserver
+	// framed counts bytes written by websocket, it is nil if not measured
+	framed *int64
+	// compressMin is minimal size of compressed message, zero if compression is off
+	compressMin int
+	codec       Codec
 
+	// C is closed once the socket is closed, either by peer or locally
 	C chan struct{}
 }
 
-func (cs Socket) readPump() {
-	cs.waitGroup.Add(1)
+func (cs *Socket) readPump() {
 	defer cs.waitGroup.Done()
 
 	cs.conn.SetReadLimit(MaxMessageSize)
 	cs.conn.SetReadDeadline(time.Now().Add(PongWait))
-	cs.conn.SetPongHandler(func(string) error { cs.conn.SetReadDeadline(time.Now().Add(PongWait)); return nil })
+	cs.conn.SetPongHandler(func(payload string) error {
+		cs.conn.SetReadDeadline(time.Now().Add(PongWait))
+		if cs.observer != nil {
+			cs.observer.Pong(payload, time.Now())
+		}
+		return nil
+	})
 
 	for {
-		_, message, err := cs.conn.ReadMessage()
+		messageType, data, err := cs.conn.ReadMessage()
 
 		if err != nil {
-			if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseAbnormalClosure) {
+			if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseAbnormalClosure, websocket.CloseNormalClosure) {
 				log.Println("Read failed: ", err)
-
 			}
 			cs.Close()
 			return
 		}
 
-		cs.rx <- message
+		// Text frames are always JSON, peer may use them regardless of codec
+		message := data
+		if messageType == websocket.BinaryMessage {
+			message, err = cs.codec.Decode(data)
+			if err != nil {
+				log.Println("Failed to decode message: ", err)
+				continue
+			}
+		}
+		if cs.observer != nil {
+			cs.observer.Received(message, len(data))
+		}
+
+		select {
+		case cs.rx <- message:
+		case <-cs.C:
+			return
+		}
+	}
+}
+
+func (cs *Socket) write(message []byte) bool {
+	data, err := cs.codec.Encode(message)
+	if err != nil {
+		log.Println("Failed to encode message: ", err)
+		return true
+	}
+	if cs.compressMin > 0 {
+		cs.conn.EnableWriteCompression(len(data) >= cs.compressMin)
+	}
+	var framed int64
+	if cs.framed != nil {
+		framed = atomic.LoadInt64(cs.framed)
 	}
+	cs.conn.SetWriteDeadline(time.Now().Add(WriteWait))
+	if err := cs.conn.WriteMessage(cs.codec.MessageType(), data); err != nil {
+		log.Println("Write to send request: ", err)
+		cs.Close()
+		return false
+	}
+	if cs.observer != nil {
+		frame := 0
+		if cs.framed != nil {
+			// Messages are written by write pump only, so written bytes are the message frame
+			frame = int(atomic.LoadInt64(cs.framed) - framed)
+		}
+		cs.observer.Sent(message, len(data), frame)
+	}
+	return true
 }
 
-func (cs Socket) writePump() {
-	cs.waitGroup.Add(1)
+func (cs *Socket) writePump() {
 	defer cs.waitGroup.Done()
 
 	for {
+		// Priority lane is always drained before anything else is written
+		select {
+		case message := <-cs.priority:
+			if !cs.write(message) {
+				return
+			}
+			continue
+		default:
+		}
+
 		select {
+		case message := <-cs.priority:
+			if !cs.write(message) {
+				return
+			}
+
 		case message, ok := <-cs.tx:
-			cs.conn.SetWriteDeadline(time.Now().Add(WriteWait))
 			if !ok {
-				cs.conn.WriteMessage(websocket.CloseMessage, []byte{})
 				cs.Close()
-				break
+				return
 			}
-
-			if err := cs.conn.WriteMessage(websocket.TextMessage, message); err != nil {
-				log.Println("Write to send request: ", err)
-				cs.Close()
-				break
+			if !cs.write(message) {
+				return
 			}
 
-		case <-cs.ticker.C:
+		case now := <-cs.ticker.C:
+			var payload []byte
+			if cs.observer != nil {
+				payload = cs.observer.Ping(now)
+			}
 			cs.conn.SetWriteDeadline(time.Now().Add(WriteWait))
-			if err := cs.conn.WriteMessage(websocket.PingMessage, nil); err != nil {
+			if err := cs.conn.WriteMessage(websocket.PingMessage, payload); err != nil {
 				log.Println("Ping failed: ", err)
 				cs.Close()
-				break
+				return
 			}
+		case <-cs.ctx.Done():
+			cs.Close()
+			return
+		case <-cs.C:
+			return
 		}
 	}
 }
 
-func (cs Socket) Close() {
-	cs.conn.Close()
-	cs.ticker.Stop()
-	cs.C <- struct{}{}
+// Close sends a close frame to the peer and releases the connection. It is
+// safe to call multiple times and from any goroutine.
+func (cs *Socket) Close() {
+	cs.closeOnce.Do(func() {
+		// WriteControl may be used concurrently with the write pump
+		cs.conn.WriteControl(websocket.CloseMessage,
+			websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""),
+			time.Now().Add(WriteWait))
+		cs.conn.Close()
+		cs.ticker.Stop()
+		close(cs.C)
+	})
 }
 
-func NewSocket(socketUrl url.URL, jar *cookiejar.Jar, rx chan []byte, tx chan []byte, wg *sync.WaitGroup) (*Socket, error) {
+// NewSocket dials socketUrl and starts read and write pumps. Cancelling ctx
+// closes the socket gracefully; pumps are accounted in wg.
+func NewSocket(ctx context.Context, socketUrl url.URL, jar *cookiejar.Jar, rx chan []byte, tx chan []byte, options SocketOptions, wg *sync.WaitGroup) (*Socket, error) {
 	log.Printf("Connecting to %s", socketUrl.String())
 
 	var cloudDialer = &websocket.Dialer{
-		Proxy:            http.ProxyFromEnvironment,
-		HandshakeTimeout: 45 * time.Second,
-		Jar:              jar,
+		Proxy:             http.ProxyFromEnvironment,
+		HandshakeTimeout:  45 * time.Second,
+		Jar:               jar,
+		EnableCompression: options.Compression.Enabled,
+		Subprotocols:      codecSubprotocols(options.Codecs),
+	}
+	var framed *int64
+	if observer := options.Observer; observer != nil {
+		written := new(int64)
+		netDialer := &net.Dialer{}
+		dial := func(ctx context.Context, network string, addr string) (net.Conn, error) {
+			conn, err := netDialer.DialContext(ctx, network, addr)
+			if err != nil {
+				return nil, err
+			}
+			return countingConn{Conn: conn, observer: observer}, nil
+		}
+		cloudDialer.NetDialContext = dial
+
+		// Frames are counted above TLS, so TLS is set up here. Proxy would be
+		// dialed with the same function, frames are not measured through it.
+		proxyUrl, _ := cloudDialer.Proxy(&http.Request{URL: &url.URL{Scheme: "https", Host: socketUrl.Host}})
+		switch {
+		case socketUrl.Scheme == "ws":
+			cloudDialer.NetDialContext = func(ctx context.Context, network string, addr string) (net.Conn, error) {
+				conn, err := dial(ctx, network, addr)
+				if err != nil {
+					return nil, err
+				}
+				return framingConn{Conn: conn, written: written}, nil
+			}
+			framed = written
+		case proxyUrl == nil:
+			cloudDialer.NetDialTLSContext = func(ctx context.Context, network string, addr string) (net.Conn, error) {
+				conn, err := dial(ctx, network, addr)
+				if err != nil {
+					return nil, err
+				}
+				host, _, err := net.SplitHostPort(addr)
+				if err != nil {
+					host = addr
+				}
+				tlsConn := tls.Client(conn, &tls.Config{ServerName: host})
+				if err := tlsConn.HandshakeContext(ctx); err != nil {
+					conn.Close()
+					return nil, err
+				}
+				return framingConn{Conn: tlsConn, written: written}, nil
+			}
+			framed = written
+		}
 	}
-	conn, _, err := cloudDialer.Dial(socketUrl.String(), nil)
+	conn, response, err := cloudDialer.DialContext(ctx, socketUrl.String(), nil)
 
 	if err != nil {
 		log.Println("Handshake failed:", err)
@@ -107,16 +311,43 @@ func NewSocket(socketUrl url.URL, jar *cookiejar.Jar, rx chan []byte, tx chan []
 	}
 	log.Println("Connected")
 
-	socket := Socket{
+	socket := &Socket{
 		conn:      conn,
 		rx:        rx,
 		tx:        tx,
+		priority:  options.Priority,
+		observer:  options.Observer,
+		framed:    framed,
 		waitGroup: wg,
+		ctx:       ctx,
 		ticker:    time.NewTicker(PingPeriod),
+		codec:     negotiatedCodec(conn.Subprotocol()),
+		C:         make(chan struct{}),
+	}
+	if socket.codec.Name() != CodecJSON {
+		log.Println("Using ", socket.codec.Name(), " codec")
+	}
+
+	if options.Compression.Enabled {
+		if strings.Contains(response.Header.Get("Sec-Websocket-Extensions"), "permessage-deflate") {
+			log.Println("Compression negotiated")
+			socket.compressMin = options.Compression.MinSize
+			if socket.compressMin <= 0 {
+				socket.compressMin = DefaultCompressionMinSize
+			}
+			if level := options.Compression.Level; level != 0 {
+				if err := conn.SetCompressionLevel(level); err != nil {
+					log.Println("Invalid compression level: ", err)
+				}
+			}
+		} else {
+			log.Println("Peer does not support compression")
+		}
 	}
 
+	wg.Add(2)
 	go socket.readPump()
 	go socket.writePump()
 
-	return &socket, nil
+	return socket, nil
 }
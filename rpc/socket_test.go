@@ -0,0 +1,293 @@
+package rpc
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/finomen/go-moonraker-api/api"
+	"github.com/gorilla/websocket"
+	"klipper-cloud-control-client/config"
+	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// bulkSize makes each bulk message take noticeable time to write
+const bulkSize = 64 * 1024
+
+func bulkMessage(id int) []byte {
+	return []byte(fmt.Sprintf(`{"jsonrpc":"2.0","method":"server.files.metadata","params":{"filename":"%s"},"id":%d}`,
+		strings.Repeat("x", bulkSize), 1000000+id))
+}
+
+func isEmergencyStop(message []byte) bool {
+	return bytes.Contains(message, []byte(`"`+api.PrinterEmergencyStop.Name+`"`))
+}
+
+// newPrinterServer starts websocket server which consumes every message,
+// forwards it to received and answers emergency stop. Reading each bulk
+// message takes delay, so socket writes block like on a busy printer.
+func newPrinterServer(t *testing.T, received chan []byte, delay time.Duration) url.URL {
+	upgrader := websocket.Upgrader{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		for {
+			_, message, err := conn.ReadMessage()
+			if err != nil {
+				return
+			}
+			if isEmergencyStop(message) {
+				request := rawRequest{}
+				json.Unmarshal(message, &request)
+				conn.WriteMessage(websocket.TextMessage,
+					[]byte(fmt.Sprintf(`{"jsonrpc":"2.0","result":"ok","id":%d}`, request.Id)))
+			} else {
+				time.Sleep(delay)
+			}
+			select {
+			case received <- message:
+			default:
+			}
+		}
+	}))
+	t.Cleanup(server.Close)
+
+	socketUrl, err := url.Parse(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	socketUrl.Scheme = "ws"
+	return *socketUrl
+}
+
+// sentRecorder records messages in order socket wrote them
+type sentRecorder struct {
+	mutex  sync.Mutex
+	sent   [][]byte
+	frames []int
+}
+
+func (r *sentRecorder) Ping(now time.Time) []byte          { return nil }
+func (r *sentRecorder) Pong(payload string, now time.Time) {}
+func (r *sentRecorder) Received(message []byte, size int)  {}
+func (r *sentRecorder) Wire(sent int, received int)        {}
+
+func (r *sentRecorder) Sent(message []byte, size int, frame int) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.sent = append(r.sent, message)
+	r.frames = append(r.frames, frame)
+}
+
+func (r *sentRecorder) Count() int {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return len(r.sent)
+}
+
+// position returns index of emergency stop in sent messages, -1 if not sent
+func (r *sentRecorder) position() int {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	for i, message := range r.sent {
+		if isEmergencyStop(message) {
+			return i
+		}
+	}
+	return -1
+}
+
+type printerLink struct {
+	client   *RawClient
+	tx       chan []byte
+	priority chan []byte
+	rx       chan []byte
+}
+
+func newPrinterLink() *printerLink {
+	link := &printerLink{
+		tx:       make(chan []byte, ChannelSize),
+		priority: make(chan []byte, ChannelSize),
+		rx:       make(chan []byte, ChannelSize),
+	}
+	link.client = NewRawClient(link.rx, link.tx, link.priority, func(string, json.RawMessage, []byte) bool {
+		return false
+	})
+	link.client.Connected()
+	return link
+}
+
+func (l *printerLink) connect(t *testing.T, ctx context.Context, socketUrl url.URL, observer SocketObserver) {
+	jar, _ := cookiejar.New(nil)
+	wg := &sync.WaitGroup{}
+	socket, err := NewSocket(ctx, socketUrl, jar, l.rx, l.tx, SocketOptions{
+		Priority: l.priority,
+		Observer: observer,
+	}, wg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		socket.Close()
+		wg.Wait()
+		l.client.Close()
+	})
+}
+
+func (l *printerLink) emergencyStop(ctx context.Context) chan *Error {
+	done := make(chan *Error, 1)
+	go func() {
+		_, err := l.client.Call(ctx, api.PrinterEmergencyStop.Name, struct{}{})
+		done <- err
+	}()
+	return done
+}
+
+func TestSocketPriorityWrittenFirst(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	received := make(chan []byte, 2*ChannelSize)
+	socketUrl := newPrinterServer(t, received, 0)
+	link := newPrinterLink()
+
+	for i := 0; i < cap(link.tx); i++ {
+		link.tx <- bulkMessage(i)
+	}
+	done := link.emergencyStop(ctx)
+	for len(link.priority) == 0 {
+		if ctx.Err() != nil {
+			t.Fatal("emergency stop was not queued to priority lane")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	link.connect(t, ctx, socketUrl, nil)
+
+	select {
+	case message := <-received:
+		if !isEmergencyStop(message) {
+			t.Fatalf("first message is %.80s", message)
+		}
+	case <-ctx.Done():
+		t.Fatal("nothing received")
+	}
+	if err := <-done; err != nil {
+		t.Fatalf("emergency stop failed: %s", err.Message)
+	}
+}
+
+func TestSocketPriorityLatency(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	received := make(chan []byte, 2*ChannelSize)
+	socketUrl := newPrinterServer(t, received, time.Millisecond)
+	link := newPrinterLink()
+	recorder := &sentRecorder{}
+	link.connect(t, ctx, socketUrl, recorder)
+
+	// Keep tx full for the whole test
+	flooding, stopFlood := context.WithCancel(ctx)
+	defer stopFlood()
+	bulk := bulkMessage(0)
+	go func() {
+		for {
+			select {
+			case link.tx <- bulk:
+			case <-flooding.Done():
+				return
+			}
+		}
+	}()
+	for recorder.Count() < 16 || len(link.tx) < cap(link.tx) {
+		if ctx.Err() != nil {
+			t.Fatal("bulk messages are not written")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	sentBefore := recorder.Count()
+	started := time.Now()
+	if err := <-link.emergencyStop(ctx); err != nil {
+		t.Fatalf("emergency stop failed: %s", err.Message)
+	}
+	latency := time.Since(started)
+
+	// At most the message being written when emergency stop was queued may precede it
+	if position := recorder.position(); position < 0 || position > sentBefore+1 {
+		t.Errorf("emergency stop written at %d, %d messages were written before it was queued",
+			position, sentBefore)
+	}
+	if latency > time.Second {
+		t.Errorf("emergency stop took %s behind %d queued messages", latency, len(link.tx))
+	}
+}
+
+func TestSocketFrameSize(t *testing.T) {
+	upgrader := websocket.Upgrader{EnableCompression: true}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}))
+	t.Cleanup(server.Close)
+	socketUrl, _ := url.Parse(server.URL)
+	socketUrl.Scheme = "ws"
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	recorder := &sentRecorder{}
+	tx := make(chan []byte, 2)
+	jar, _ := cookiejar.New(nil)
+	wg := &sync.WaitGroup{}
+	socket, err := NewSocket(ctx, *socketUrl, jar, make(chan []byte, 1), tx, SocketOptions{
+		Observer:    recorder,
+		Compression: config.CompressionConfig{Enabled: true},
+	}, wg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		socket.Close()
+		wg.Wait()
+	})
+
+	small := []byte(`{"jsonrpc":"2.0","method":"printer.info","id":1}`)
+	bulk := bulkMessage(2)
+	tx <- small
+	tx <- bulk
+	for recorder.Count() < 2 {
+		if ctx.Err() != nil {
+			t.Fatal("messages are not written")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	recorder.mutex.Lock()
+	defer recorder.mutex.Unlock()
+	// Client frames carry 4 byte mask and 2 byte header
+	if frame := recorder.frames[0]; frame != len(small)+6 {
+		t.Errorf("uncompressed frame is %d bytes, message %d", frame, len(small))
+	}
+	if frame := recorder.frames[1]; frame <= 0 || frame > len(bulk)/10 {
+		t.Errorf("compressed frame is %d bytes, message %d", frame, len(bulk))
+	}
+}
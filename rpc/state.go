@@ -0,0 +1,236 @@
+package rpc
+
+import (
+	"encoding/json"
+	"github.com/finomen/go-moonraker-api/api"
+	"github.com/finomen/go-moonraker-api/jsonrpc"
+	"log"
+	"sync"
+	"time"
+)
+
+const (
+	KlippyReady        = "ready"
+	KlippyStartup      = "startup"
+	KlippyShutdown     = "shutdown"
+	KlippyError        = "error"
+	KlippyDisconnected = "disconnected"
+)
+
+type JobState struct {
+	Filename string  `json:"filename"`
+	State    string  `json:"state"`
+	Progress float64 `json:"progress"`
+}
+
+type StateSnapshot struct {
+	Eventtime          float64         `json:"eventtime"`
+	Status             json.RawMessage `json:"status"`
+	PrinterConnected   bool            `json:"printer_connected"`
+	KlippyState        string          `json:"klippy_state"`
+	KlippyStateMessage string          `json:"klippy_state_message"`
+	Job                *JobState       `json:"job"`
+	FileListRevision   uint64          `json:"file_list_revision"`
+	// Seq is the latest journal sequence number included into this snapshot
+	Seq uint64 `json:"seq"`
+}
+
+// StateSnapshotNotify pushes full printer state to freshly connected cloud session
+var StateSnapshotNotify = jsonrpc.Notify[[]StateSnapshot]{Name: "kcc.state.snapshot"}
+
+type PrinterConnection struct {
+	Connected bool      `json:"connected"`
+	Time      time.Time `json:"ts"`
+}
+
+// PrinterConnectionNotify tells cloud that connection to Moonraker was established or lost
+var PrinterConnectionNotify = jsonrpc.Notify[[]PrinterConnection]{Name: "kcc.printer.connection"}
+
+// PrinterState mirrors printer object state as seen through bridged queries
+// and status update notifications.
+type PrinterState struct {
+	mutex              sync.Mutex
+	status             objectStatus
+	eventtime          float64
+	printerConnected   bool
+	klippyState        string
+	klippyStateMessage string
+	fileListRevision   uint64
+	// ready is closed while Klippy is ready
+	ready chan struct{}
+}
+
+// objectStatus keeps field values undecoded, Moonraker sends changed fields as a whole
+type objectStatus map[string]map[string]json.RawMessage
+
+type objectsQueryResult struct {
+	Eventtime float64      `json:"eventtime"`
+	Status    objectStatus `json:"status"`
+}
+
+func (s *PrinterState) mergeStatus(status objectStatus, eventtime float64) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	for object, fields := range status {
+		current, ok := s.status[object]
+		if !ok {
+			current = map[string]json.RawMessage{}
+			s.status[object] = current
+		}
+		for field, value := range fields {
+			current[field] = value
+		}
+	}
+	if eventtime > s.eventtime {
+		s.eventtime = eventtime
+	}
+}
+
+// ObserveResult updates mirror from raw result of a bridged call
+func (s *PrinterState) ObserveResult(method string, result json.RawMessage) {
+	switch method {
+	case api.PrinterObjectsQuery.Name, api.PrinterObjectsSubscribe.Name:
+		response := objectsQueryResult{}
+		if err := json.Unmarshal(result, &response); err == nil {
+			s.mergeStatus(response.Status, response.Eventtime)
+		}
+	case api.PrinterInfo.Name:
+		response := api.PrinterInfoResponse{}
+		if err := json.Unmarshal(result, &response); err == nil {
+			s.SetKlippyState(response.State, response.StateMessage)
+		}
+	}
+}
+
+// ObserveNotify updates mirror from raw params of printer notification
+func (s *PrinterState) ObserveNotify(method string, params json.RawMessage) {
+	switch method {
+	case api.NotifyStatusUpdate.Name:
+		// Params are split by scanning, only status object itself is decoded
+		update, ok := splitArray(params)
+		if !ok || len(update) == 0 {
+			return
+		}
+		status := objectStatus{}
+		if err := json.Unmarshal(update[0], &status); err != nil {
+			return
+		}
+		var eventtime float64
+		if len(update) > 1 {
+			json.Unmarshal(update[1], &eventtime)
+		}
+		s.mergeStatus(status, eventtime)
+	case api.NotifyKlippyReady.Name:
+		s.SetKlippyState(KlippyReady, "")
+	case api.NotifyKlippyShutdown.Name:
+		s.SetKlippyState(KlippyShutdown, "")
+	case api.NotifyKlippyDisconnected.Name:
+		s.SetKlippyState(KlippyDisconnected, "")
+	case api.NotifyFileListChanged.Name:
+		s.mutex.Lock()
+		s.fileListRevision++
+		s.mutex.Unlock()
+	}
+}
+
+// setKlippyState must be called under lock
+func (s *PrinterState) setKlippyState(state string, message string) {
+	wasReady := s.klippyState == KlippyReady
+	s.klippyState = state
+	s.klippyStateMessage = message
+	if state == KlippyReady && !wasReady {
+		close(s.ready)
+	} else if state != KlippyReady && wasReady {
+		s.ready = make(chan struct{})
+	}
+}
+
+func (s *PrinterState) SetKlippyState(state string, message string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.setKlippyState(state, message)
+}
+
+// KlippyState returns klippy state and its message, state is empty while
+// unknown after printer connection is established
+func (s *PrinterState) KlippyState() (string, string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.klippyState, s.klippyStateMessage
+}
+
+// Ready returns channel closed once Klippy is ready
+func (s *PrinterState) Ready() <-chan struct{} {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.ready
+}
+
+func (s *PrinterState) SetPrinterConnected(connected bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.printerConnected = connected
+	if connected {
+		s.setKlippyState("", "")
+	} else {
+		s.setKlippyState(KlippyDisconnected, "")
+	}
+}
+
+func (s *PrinterState) PrinterConnected() bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.printerConnected
+}
+
+// field decodes mirrored field value, missing or malformed value yields zero value
+func field[T interface{}](object map[string]json.RawMessage, name string) T {
+	var value T
+	if raw, ok := object[name]; ok {
+		json.Unmarshal(raw, &value)
+	}
+	return value
+}
+
+func (s *PrinterState) job() *JobState {
+	printStats, ok := s.status["print_stats"]
+	if !ok {
+		return nil
+	}
+	return &JobState{
+		Filename: field[string](printStats, "filename"),
+		State:    field[string](printStats, "state"),
+		Progress: field[float64](s.status["virtual_sdcard"], "progress"),
+	}
+}
+
+// Snapshot returns deep copy of mirrored state
+func (s *PrinterState) Snapshot() StateSnapshot {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	status, err := json.Marshal(s.status)
+	if err != nil {
+		log.Println("Failed to serialize printer state: ", err)
+		status = []byte("{}")
+	}
+
+	return StateSnapshot{
+		Eventtime:          s.eventtime,
+		Status:             status,
+		PrinterConnected:   s.printerConnected,
+		KlippyState:        s.klippyState,
+		KlippyStateMessage: s.klippyStateMessage,
+		Job:                s.job(),
+		FileListRevision:   s.fileListRevision,
+	}
+}
+
+func NewPrinterState() *PrinterState {
+	return &PrinterState{
+		status:      objectStatus{},
+		klippyState: KlippyDisconnected,
+		ready:       make(chan struct{}),
+	}
+}
@@ -0,0 +1,97 @@
+package rpc
+
+import (
+	"github.com/finomen/go-moonraker-api/api"
+	"sort"
+	"sync"
+)
+
+// Subscriptions records union of printer objects subscribed by current cloud
+// session. Moonraker replaces subscription on each subscribe call, so the
+// union is what is actually forwarded and what is replayed after printer
+// reconnect or klippy restart.
+type Subscriptions struct {
+	mutex   sync.Mutex
+	objects map[string][]string
+}
+
+// Add merges request into active subscriptions and returns resulting union.
+// Nil or empty field list means all fields of the object.
+func (s *Subscriptions) Add(request api.PrinterObjectsQueryRequest) api.PrinterObjectsQueryRequest {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	for object, fields := range request.Objects {
+		current, ok := s.objects[object]
+		if !ok {
+			s.objects[object] = copyFields(fields)
+			continue
+		}
+		if len(current) == 0 || len(fields) == 0 {
+			s.objects[object] = nil
+			continue
+		}
+		s.objects[object] = unionFields(current, fields)
+	}
+
+	return s.request()
+}
+
+// Request returns union of active subscriptions, empty if nothing is subscribed
+func (s *Subscriptions) Request() api.PrinterObjectsQueryRequest {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.request()
+}
+
+func (s *Subscriptions) request() api.PrinterObjectsQueryRequest {
+	objects := make(map[string][]string, len(s.objects))
+	for object, fields := range s.objects {
+		objects[object] = copyFields(fields)
+	}
+	return api.PrinterObjectsQueryRequest{Objects: objects}
+}
+
+func (s *Subscriptions) Empty() bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return len(s.objects) == 0
+}
+
+// Reset forgets subscriptions of previous cloud session
+func (s *Subscriptions) Reset() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.objects = map[string][]string{}
+}
+
+// copyFields copies field list keeping empty one as nil, null is what
+// moonraker documents as all fields of the object
+func copyFields(fields []string) []string {
+	if len(fields) == 0 {
+		return nil
+	}
+	return append([]string{}, fields...)
+}
+
+func unionFields(a []string, b []string) []string {
+	set := map[string]struct{}{}
+	for _, field := range a {
+		set[field] = struct{}{}
+	}
+	for _, field := range b {
+		set[field] = struct{}{}
+	}
+	result := make([]string, 0, len(set))
+	for field := range set {
+		result = append(result, field)
+	}
+	sort.Strings(result)
+	return result
+}
+
+func NewSubscriptions() *Subscriptions {
+	return &Subscriptions{
+		objects: map[string][]string{},
+	}
+}
@@ -0,0 +1,210 @@
+package rpc
+
+import (
+	"encoding/json"
+	"klipper-cloud-control-client/config"
+	"log"
+	"sync"
+	"time"
+)
+
+// StatusThrottle reduces status update traffic to the cloud: dropped fields
+// are filtered out, consecutive updates are merged within a window and fields
+// with configured interval are forwarded at most once per interval.
+type StatusThrottle struct {
+	window    time.Duration
+	intervals map[string]time.Duration
+	drop      []string
+	forward   func(params json.RawMessage)
+
+	mutex     sync.Mutex
+	pending   objectStatus
+	eventtime float64
+	sent      map[string]time.Time
+	timer     *time.Timer
+	deadline  time.Time
+	closed    bool
+	// adaptive is minimal window set according to uplink quality
+	adaptive time.Duration
+}
+
+func statusField(object string, field string) string {
+	return object + "/" + field
+}
+
+// Enabled reports whether status updates have to pass through throttle,
+// while anything is pending newer updates must not overtake it
+func (t *StatusThrottle) Enabled() bool {
+	if t.window > 0 || len(t.intervals) > 0 || len(t.drop) > 0 {
+		return true
+	}
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	return t.adaptive > 0 || len(t.pending) > 0
+}
+
+// SetAdaptiveWindow raises merge window, pending updates are flushed when it is removed
+func (t *StatusThrottle) SetAdaptiveWindow(window time.Duration) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.adaptive = window
+	if window <= 0 {
+		t.flushLocked()
+	}
+}
+
+// effectiveWindow must be called under lock
+func (t *StatusThrottle) effectiveWindow() time.Duration {
+	if t.adaptive > t.window {
+		return t.adaptive
+	}
+	return t.window
+}
+
+func (t *StatusThrottle) interval(object string, field string) time.Duration {
+	if _, interval, ok := bestMatch(t.intervals, statusField(object, field)); ok {
+		return interval
+	}
+	_, interval, _ := bestMatch(t.intervals, object)
+	return interval
+}
+
+// Add filters status update params and merges them into pending update
+func (t *StatusThrottle) Add(params json.RawMessage) {
+	update := []json.RawMessage{}
+	if err := json.Unmarshal(params, &update); err != nil || len(update) == 0 {
+		return
+	}
+	status := objectStatus{}
+	if err := json.Unmarshal(update[0], &status); err != nil {
+		log.Println("Failed to parse status update: ", err)
+		return
+	}
+	var eventtime float64
+	if len(update) > 1 {
+		json.Unmarshal(update[1], &eventtime)
+	}
+
+	t.mutex.Lock()
+	for object, fields := range status {
+		if matchMethod(t.drop, object) {
+			continue
+		}
+		for field, value := range fields {
+			if matchMethod(t.drop, statusField(object, field)) {
+				continue
+			}
+			current, ok := t.pending[object]
+			if !ok {
+				current = map[string]json.RawMessage{}
+				t.pending[object] = current
+			}
+			current[field] = value
+		}
+	}
+	if eventtime > t.eventtime {
+		t.eventtime = eventtime
+	}
+	if window := t.effectiveWindow(); window > 0 {
+		t.schedule(window)
+	} else {
+		t.flushLocked()
+	}
+	t.mutex.Unlock()
+}
+
+// schedule arranges flush after delay unless it is already due earlier, must be called under lock
+func (t *StatusThrottle) schedule(delay time.Duration) {
+	if t.closed {
+		return
+	}
+	deadline := time.Now().Add(delay)
+	if t.timer != nil {
+		if !t.deadline.After(deadline) {
+			return
+		}
+		t.timer.Stop()
+	}
+	t.deadline = deadline
+	t.timer = time.AfterFunc(delay, t.flush)
+}
+
+func (t *StatusThrottle) flush() {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.flushLocked()
+}
+
+// flushLocked forwards pending fields which are due, the rest is rescheduled.
+// Updates are forwarded under lock so they keep their order.
+func (t *StatusThrottle) flushLocked() {
+	if t.timer != nil {
+		t.timer.Stop()
+		t.timer = nil
+	}
+	if t.closed {
+		return
+	}
+
+	now := time.Now()
+	due := objectStatus{}
+	var next time.Duration
+	for object, fields := range t.pending {
+		for field, value := range fields {
+			key := statusField(object, field)
+			if interval := t.interval(object, field); interval > 0 {
+				if wait := interval - now.Sub(t.sent[key]); wait > 0 {
+					if next == 0 || wait < next {
+						next = wait
+					}
+					continue
+				}
+				t.sent[key] = now
+			}
+			current, ok := due[object]
+			if !ok {
+				current = map[string]json.RawMessage{}
+				due[object] = current
+			}
+			current[field] = value
+			delete(fields, field)
+		}
+		if len(fields) == 0 {
+			delete(t.pending, object)
+		}
+	}
+	if next > 0 {
+		t.schedule(next)
+	}
+
+	if len(due) == 0 {
+		return
+	}
+	params, err := json.Marshal([]interface{}{due, t.eventtime})
+	if err != nil {
+		log.Println("Failed to serialize status update: ", err)
+		return
+	}
+	t.forward(params)
+}
+
+func (t *StatusThrottle) Close() {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.closed = true
+	if t.timer != nil {
+		t.timer.Stop()
+		t.timer = nil
+	}
+}
+
+func NewStatusThrottle(cfg config.StatusConfig, forward func(params json.RawMessage)) *StatusThrottle {
+	return &StatusThrottle{
+		window:    cfg.Window,
+		intervals: cfg.Intervals,
+		drop:      cfg.Drop,
+		forward:   forward,
+		pending:   objectStatus{},
+		sent:      map[string]time.Time{},
+	}
+}
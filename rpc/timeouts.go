@@ -0,0 +1,107 @@
+package rpc
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/finomen/go-moonraker-api/jsonrpc"
+	"klipper-cloud-control-client/config"
+	"sync"
+	"time"
+)
+
+var defaultTimeouts = map[string]time.Duration{
+	"machine.update.*":      30 * time.Minute,
+	"server.files.copy":     10 * time.Minute,
+	"server.files.move":     2 * time.Minute,
+	"printer.objects.query": 5 * time.Second,
+	"printer.info":          5 * time.Second,
+	"server.info":           5 * time.Second,
+}
+
+// Timeouts resolves call timeout by method, exact names win over patterns
+// and longer patterns win over shorter ones
+type Timeouts struct {
+	fallback time.Duration
+	methods  map[string]time.Duration
+}
+
+func (t *Timeouts) For(method string) time.Duration {
+	if _, value, ok := bestMatch(t.methods, method); ok {
+		return value
+	}
+	return t.fallback
+}
+
+func NewTimeouts(cfg config.TimeoutsConfig) *Timeouts {
+	timeouts := &Timeouts{
+		fallback: cfg.Default,
+		methods:  map[string]time.Duration{},
+	}
+	if timeouts.fallback <= 0 {
+		timeouts.fallback = timeout
+	}
+	for method, value := range defaultTimeouts {
+		timeouts.methods[method] = value
+	}
+	for method, value := range cfg.Methods {
+		timeouts.methods[method] = value
+	}
+	return timeouts
+}
+
+type CancelRequest struct {
+	Id json.RawMessage `json:"id"`
+}
+
+type CancelResponse struct {
+	Cancelled bool `json:"cancelled"`
+}
+
+// Cancel lets cloud abandon pending request by its id
+var Cancel = jsonrpc.Method[CancelRequest, CancelResponse]{Name: "kcc.cancel"}
+
+type pendingCall struct {
+	cancel context.CancelFunc
+	user   *CloudUser
+}
+
+// PendingCalls tracks cancellable in-flight cloud requests by request id
+type PendingCalls struct {
+	mutex sync.Mutex
+	calls map[string]pendingCall
+}
+
+func (p *PendingCalls) Add(id json.RawMessage, user *CloudUser, cancel context.CancelFunc) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.calls[string(id)] = pendingCall{cancel: cancel, user: user}
+}
+
+func (p *PendingCalls) Remove(id json.RawMessage) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	delete(p.calls, string(id))
+}
+
+// Cancel aborts pending call, only the user who issued it may cancel it
+func (p *PendingCalls) Cancel(id json.RawMessage, user *CloudUser) bool {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	call, ok := p.calls[string(id)]
+	if !ok {
+		return false
+	}
+	if call.user != nil && (user == nil || user.Id != call.user.Id) {
+		return false
+	}
+	call.cancel()
+	delete(p.calls, string(id))
+	return true
+}
+
+func NewPendingCalls() *PendingCalls {
+	return &PendingCalls{
+		calls: map[string]pendingCall{},
+	}
+}
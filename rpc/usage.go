@@ -0,0 +1,316 @@
+package rpc
+
+import (
+	"encoding/json"
+	"github.com/finomen/go-moonraker-api/jsonrpc"
+	"klipper-cloud-control-client/config"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultUsagePath = "usage.json"
+	usageInterval    = 10 * time.Second
+	usageMonthFormat = "2006-01"
+)
+
+const (
+	UsageTx = "tx"
+	UsageRx = "rx"
+)
+
+const (
+	CategoryNotifications = "notifications"
+	CategoryRpc           = "rpc"
+	CategoryFiles         = "files"
+)
+
+type UsageCounters struct {
+	Notifications int64 `json:"notifications"`
+	Rpc           int64 `json:"rpc"`
+	Files         int64 `json:"files"`
+}
+
+func (c *UsageCounters) add(category string, bytes int64) {
+	switch category {
+	case CategoryNotifications:
+		c.Notifications += bytes
+	case CategoryFiles:
+		c.Files += bytes
+	default:
+		c.Rpc += bytes
+	}
+}
+
+func (c *UsageCounters) Total() int64 {
+	return c.Notifications + c.Rpc + c.Files
+}
+
+// UsageWire counts bytes of cloud socket connection as sent over network,
+// including TLS, websocket framing and compression
+type UsageWire struct {
+	Tx int64 `json:"tx"`
+	Rx int64 `json:"rx"`
+}
+
+type UsageStats struct {
+	Month   string        `json:"month"`
+	Tx      UsageCounters `json:"tx"`
+	Rx      UsageCounters `json:"rx"`
+	Wire    UsageWire     `json:"wire"`
+	Total   int64         `json:"total"`
+	Cap     int64         `json:"cap"`
+	LowData bool          `json:"low_data"`
+}
+
+type UsageStatsRequest struct {
+}
+
+// UsageStatsMethod lets cloud query data usage of the current month
+var UsageStatsMethod = jsonrpc.Method[UsageStatsRequest, UsageStats]{Name: "kcc.usage.stats"}
+
+// UsageNotify reports data usage when low-data mode is switched
+var UsageNotify = jsonrpc.Notify[[]UsageStats]{Name: "kcc.usage"}
+
+type usageState struct {
+	Month string        `json:"month"`
+	Tx    UsageCounters `json:"tx"`
+	Rx    UsageCounters `json:"rx"`
+	Wire  UsageWire     `json:"wire"`
+}
+
+// total is traffic counted toward monthly cap. Socket traffic is taken from
+// network bytes when they are measured, message payload counters only break
+// it down by category. Uploads do not go through the socket and are added
+// on top of it.
+func (s *usageState) total() int64 {
+	wire := s.Wire.Tx + s.Wire.Rx
+	if wire == 0 {
+		return s.Tx.Total() + s.Rx.Total()
+	}
+	return wire + s.Tx.Files + s.Rx.Files
+}
+
+// Usage counts cloud traffic by direction and category for the current
+// month. Counters are saved periodically and start over every month. Once
+// monthly cap is exceeded the client switches to low-data mode: status
+// updates are no longer streamed and file uploads are refused.
+type Usage struct {
+	mutex    sync.Mutex
+	path     string
+	cap      int64
+	state    usageState
+	lowData  bool
+	reported bool
+	dirty    bool
+}
+
+// classify determines traffic category of jsonrpc message from its header
+func classify(message []byte) string {
+	if header, ok := scanHeader(message); ok && header.notification() {
+		return CategoryNotifications
+	}
+	return CategoryRpc
+}
+
+func (u *Usage) Add(direction string, category string, bytes int) {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+
+	if direction == UsageTx {
+		u.state.Tx.add(category, int64(bytes))
+	} else {
+		u.state.Rx.add(category, int64(bytes))
+	}
+	u.dirty = true
+	u.update()
+}
+
+// AddWire accounts bytes transferred over cloud socket connection
+func (u *Usage) AddWire(sent int, received int) {
+	if sent == 0 && received == 0 {
+		return
+	}
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+
+	u.state.Wire.Tx += int64(sent)
+	u.state.Wire.Rx += int64(received)
+	u.dirty = true
+	u.update()
+}
+
+// update switches low-data mode, must be called under lock
+func (u *Usage) update() {
+	u.lowData = u.cap > 0 && u.state.total() >= u.cap
+}
+
+func (u *Usage) LowData() bool {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+	return u.lowData
+}
+
+// stats must be called under lock
+func (u *Usage) stats() UsageStats {
+	return UsageStats{
+		Month:   u.state.Month,
+		Tx:      u.state.Tx,
+		Rx:      u.state.Rx,
+		Wire:    u.state.Wire,
+		Total:   u.state.total(),
+		Cap:     u.cap,
+		LowData: u.lowData,
+	}
+}
+
+func (u *Usage) Stats() UsageStats {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+	return u.stats()
+}
+
+// Tick rolls counters over on month change and saves them, it reports
+// whether low-data mode changed since the previous tick
+func (u *Usage) Tick(now time.Time) (UsageStats, bool) {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+
+	if month := now.Format(usageMonthFormat); month != u.state.Month {
+		if u.state.Month != "" {
+			log.Println("Data usage of ", u.state.Month, ": ", u.state.total(), " bytes")
+		}
+		u.state = usageState{
+			Month: month,
+		}
+		u.dirty = true
+		u.update()
+	}
+
+	if u.dirty {
+		if err := u.save(); err != nil {
+			log.Println("Failed to save data usage: ", err)
+		} else {
+			u.dirty = false
+		}
+	}
+
+	changed := u.lowData != u.reported
+	u.reported = u.lowData
+	if changed && u.lowData {
+		log.Println("Monthly data cap exceeded, switching to low-data mode")
+	}
+	return u.stats(), changed
+}
+
+// save writes counters atomically, must be called under lock
+func (u *Usage) save() error {
+	data, err := json.Marshal(u.state)
+	if err != nil {
+		return err
+	}
+	tmpPath := u.path + ".tmp"
+	if err := os.WriteFile(tmpPath, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, u.path)
+}
+
+func (u *Usage) load() {
+	data, err := os.ReadFile(u.path)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Println("Failed to read data usage: ", err)
+		}
+		return
+	}
+	if err := json.Unmarshal(data, &u.state); err != nil {
+		log.Println("Failed to parse data usage: ", err)
+		return
+	}
+	u.update()
+}
+
+func (u *Usage) Close() {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+
+	if u.dirty {
+		if err := u.save(); err != nil {
+			log.Println("Failed to save data usage: ", err)
+		}
+		u.dirty = false
+	}
+}
+
+func NewUsage(cfg config.UsageConfig) *Usage {
+	usage := &Usage{
+		path: cfg.Path,
+		cap:  cfg.MonthlyCap,
+	}
+	if usage.path == "" {
+		usage.path = DefaultUsagePath
+	}
+
+	usage.load()
+	usage.Tick(time.Now())
+
+	return usage
+}
+
+// cloudObserver feeds cloud socket traffic to link monitor and usage accounting
+type cloudObserver struct {
+	bridge *Bridge
+}
+
+func (o cloudObserver) Ping(now time.Time) []byte {
+	return o.bridge.link.PingPayload(now)
+}
+
+func (o cloudObserver) Pong(payload string, now time.Time) {
+	o.bridge.link.Pong(payload, now)
+}
+
+func (o cloudObserver) Sent(message []byte, size int, frame int) {
+	o.bridge.link.Written(size, frame)
+	o.bridge.usage.Add(UsageTx, classify(message), size)
+}
+
+func (o cloudObserver) Received(message []byte, size int) {
+	o.bridge.usage.Add(UsageRx, classify(message), size)
+}
+
+func (o cloudObserver) Wire(sent int, received int) {
+	o.bridge.link.Wire(sent)
+	o.bridge.usage.AddWire(sent, received)
+}
+
+// CloudObserver is passed to cloud socket to measure its traffic
+func (b *Bridge) CloudObserver() SocketObserver {
+	return cloudObserver{
+		bridge: b,
+	}
+}
+
+// monitorUsage persists usage counters and reports low-data mode changes
+func (b *Bridge) monitorUsage() {
+	ticker := time.NewTicker(usageInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case now := <-ticker.C:
+			if stats, changed := b.usage.Tick(now); changed {
+				b.reportUsage(stats)
+			}
+		case <-b.done:
+			return
+		}
+	}
+}
+
+func (b *Bridge) reportUsage(stats UsageStats) {
+	UsageNotify.Send([]UsageStats{stats}, b.cloudConnection)
+}